@@ -1,21 +1,22 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 
-	"log"
 	"time"
 
 	"strconv"
 	"strings"
 
-	"errors"
-
 	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/connection"
+	"github.com/conejoninja/home/metrics"
+	"github.com/conejoninja/home/rules"
 	"github.com/conejoninja/home/storage"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/conejoninja/home/units"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -24,13 +25,14 @@ type lastSensorResponse map[string]common.Value
 type metaResponse map[string]common.Meta
 
 var db storage.Storage
-var c mqtt.Client
 var cfg common.HomeConfig
+var server *http.Server
 
 func sensor(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 
 	ids := strings.Split(ps.ByName("ids"), ";")
 	period := ps.ByName("period")
+	step := req.URL.Query().Get("step") == "1" || req.URL.Query().Get("step") == "true"
 	response := make(sensorResponse)
 
 	for _, id := range ids {
@@ -39,8 +41,24 @@ func sensor(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 		}
 		start, end := getPeriod(period, 0)
 		response[id]["current"] = db.GetValuesBetweenTime(id, start, end)
+		if step {
+			response[id]["current"] = withStart(id, start, response[id]["current"])
+		}
 		start, end = getPeriod(period, -1)
 		response[id]["past"] = db.GetValuesBetweenTime(id, start, end)
+		if step {
+			response[id]["past"] = withStart(id, start, response[id]["past"])
+		}
+
+		if unit := req.URL.Query().Get("unit"); unit != "" {
+			from := sensorUnit(id)
+			for k, value := range response[id]["current"] {
+				response[id]["current"][k] = convertValue(value, from, unit)
+			}
+			for k, value := range response[id]["past"] {
+				response[id]["past"][k] = convertValue(value, from, unit)
+			}
+		}
 	}
 
 	valStr, _ := json.Marshal(response)
@@ -52,8 +70,12 @@ func lastSensor(res http.ResponseWriter, req *http.Request, ps httprouter.Params
 	ids := strings.Split(ps.ByName("ids"), ";")
 	response := make(lastSensorResponse)
 
+	unit := req.URL.Query().Get("unit")
 	for _, id := range ids {
 		response[id] = db.GetLastValue(id)
+		if unit != "" {
+			response[id] = convertValue(response[id], sensorUnit(id), unit)
+		}
 	}
 
 	valStr, _ := json.Marshal(response)
@@ -69,9 +91,20 @@ func meta(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	}
 	response := make(metaResponse)
 
+	unit := req.URL.Query().Get("unit")
 	start, _ := getPeriod(period, 0)
 	for _, id := range ids {
-		response[id] = db.GetMeta([]byte(id + "-" + period + "-" + strconv.Itoa(int(start.Unix()))))
+		m := db.GetMeta([]byte(id + "-" + period + "-" + strconv.Itoa(int(start.Unix()))))
+		m.Unit = sensorUnit(id)
+		if unit != "" {
+			var err error
+			if m, err = units.ConvertMeta(m, m.Unit, unit); err != nil {
+				res.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(res, "{\"type\":\"error\",\"message\":%q}", id+": "+err.Error())
+				return
+			}
+		}
+		response[id] = m
 	}
 
 	valStr, _ := json.Marshal(response)
@@ -79,6 +112,43 @@ func meta(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 
 }
 
+// withStart adds the value in effect at the start of the period, unchanged readings are not stored
+// so the first stored value of the period could be much later
+func withStart(id string, start time.Time, values []common.Value) []common.Value {
+	if len(values) > 0 && values[0].Time != nil && !values[0].Time.After(start) {
+		return values
+	}
+	previous := db.GetLastValueBefore(id, start)
+	if previous.Time == nil {
+		return values
+	}
+	previous.Time = &start
+	return append([]common.Value{previous}, values...)
+}
+
+// sensorUnit returns the unit of a sensor, from its last value or the descriptor of its device
+func sensorUnit(id string) string {
+	if value := db.GetLastValue(id); value.Unit != "" {
+		return value.Unit
+	}
+	for _, device := range db.GetDevices() {
+		for _, out := range device.Out {
+			if device.ID+"-"+out.ID == id {
+				return out.Unit
+			}
+		}
+	}
+	return ""
+}
+
+// convertValue converts a value to the requested unit, values that can't be converted are left untouched
+func convertValue(value common.Value, from, to string) common.Value {
+	if converted, err := units.ConvertValue(value, from, to); err == nil {
+		return converted
+	}
+	return value
+}
+
 func devices(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	devices := db.GetDevices()
 	devsjson, err := json.Marshal(devices)
@@ -111,58 +181,94 @@ func event(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	fmt.Fprint(res, string(evtjson))
 }
 
-func call(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	device := ps.ByName("device")
-	function := ps.ByName("function")
-	req.ParseForm()
-	var f common.Method
-	f.Name = function
-	params := make([]common.Value, len(req.Form))
-	p := 0
-	for k, v := range req.Form {
-		if len(v) > 0 {
-			params[p].ID = k
-			params[p].Value = v[0]
-		}
+func quarantined(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	count := 10
+	if c, err := strconv.Atoi(ps.ByName("count")); err == nil {
+		count = c
 	}
-	f.Params = params
-	methodStr, _ := json.Marshal(f)
 
-	err := mqttcall(device+"-call", "["+string(methodStr)+"]", true)
+	valStr, err := json.Marshal(db.GetLastQuarantined(ps.ByName("device"), count))
 	if err != nil {
-		fmt.Fprintf(res, "{\"type\":\"error\",\"message\":\"%s\"}", err)
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"failed\"}")
 		return
 	}
-	fmt.Fprint(res, "{\"type\":\"success\",\"message\":\"Function called\"}")
+
+	fmt.Fprint(res, string(valStr))
 }
 
-func mqttcall(topic, payload string, retained bool) error {
-	tries := 0
-	for tries < 5 {
-		token := c.Publish(topic, 0, retained, payload)
-		token.Wait()
-		if token.Error() != nil {
-			if token = c.Connect(); token.Wait() && token.Error() != nil {
-				fmt.Println(token.Error())
-				tries++
-			} else {
-				return nil
-			}
-		} else {
-			return nil
-		}
+func mqttStatus(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	valStr, _ := json.Marshal(connection.Status())
+	fmt.Fprint(res, string(valStr))
+}
+
+func listRules(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	rulesjson, err := json.Marshal(rules.List())
+	if err != nil {
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"failed\"}")
+		return
 	}
-	return errors.New("Not connected")
+
+	fmt.Fprint(res, string(rulesjson))
+}
+
+func enableRule(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	toggleRule(res, ps.ByName("name"), true)
+}
+
+func disableRule(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	toggleRule(res, ps.ByName("name"), false)
+}
+
+func toggleRule(res http.ResponseWriter, name string, enabled bool) {
+	err := rules.SetEnabled(name, enabled)
+	if err != nil {
+		fmt.Fprintf(res, "{\"type\":\"error\",\"message\":\"%s\"}", err)
+		return
+	}
+	fmt.Fprint(res, "{\"type\":\"success\",\"message\":\"Rule updated\"}")
 }
 
 func cors(h httprouter.Handle) httprouter.Handle {
 	return httprouter.Handle(func(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		start := time.Now()
 		res.Header().Set("Access-Control-Allow-Origin", "*")
-		h(res, req, ps)
+		rec := &statusRecorder{ResponseWriter: res, code: http.StatusOK}
+		h(rec, req, ps)
+		metrics.Request(req.Method, route(req.URL.Path, ps), rec.code, time.Since(start))
 		return
 	})
 }
 
+// statusRecorder keeps the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// route rebuilds the route of a request from its path, so the params are not labels of the metrics
+func route(path string, ps httprouter.Params) string {
+	parts := strings.Split(path, "/")
+	for k, part := range parts {
+		for _, p := range ps {
+			if part != "" && part == p.Value {
+				parts[k] = ":" + p.Key
+				break
+			}
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func metricsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.Write(res)
+}
+
 func getPeriod(period string, current int) (start time.Time, end time.Time) {
 	start = time.Now()
 	if period != "week" && period != "month" {
@@ -194,10 +300,9 @@ func getPeriod(period string, current int) (start time.Time, end time.Time) {
 }
 
 // Start is the entry point of the API
-func Start(homecfg common.HomeConfig, dbcon storage.Storage, mqttclient mqtt.Client) {
+func Start(homecfg common.HomeConfig, dbcon storage.Storage) {
 	cfg = homecfg
 	db = dbcon
-	c = mqttclient
 
 	router := httprouter.New()
 	router.GET("/sensor/:ids", cors(sensor))
@@ -208,14 +313,74 @@ func Start(homecfg common.HomeConfig, dbcon storage.Storage, mqttclient mqtt.Cli
 	router.GET("/event/:id", cors(event))
 	router.GET("/event/:id/:count", cors(event))
 	router.GET("/devices", cors(devices))
+	router.GET("/devices/:id/shadow", cors(getShadow))
+	router.PATCH("/devices/:id/shadow", cors(patchShadow))
+	router.GET("/status/mqtt", cors(mqttStatus))
+	router.GET("/status", cors(status))
+	router.GET("/health", cors(health))
+	router.GET("/metrics", metricsHandler)
+	router.POST("/call", cors(batchCall))
 	router.POST("/call/:device/:function", cors(call))
+	router.GET("/call/:device/:id", cors(getCall))
+	router.GET("/calls/:device", cors(calls))
+	router.GET("/calls/:device/:count", cors(calls))
+	router.GET("/queue/:device", cors(queue))
+	router.DELETE("/queue/:device/:id", cors(cancelQueued))
+	router.GET("/quarantine/:device", cors(quarantined))
+	router.GET("/quarantine/:device/:count", cors(quarantined))
+	router.GET("/deadletters", cors(deadLetters))
+	router.GET("/deadletters/:count", cors(deadLetters))
+	router.POST("/deadletters/:id/replay", cors(replayDeadLetter))
+	router.DELETE("/deadletters/:id", cors(deleteDeadLetter))
+	router.GET("/rules", cors(listRules))
+	router.POST("/rules/:name/enable", cors(enableRule))
+	router.POST("/rules/:name/disable", cors(disableRule))
+	router.GET("/schedules", cors(schedules))
+	router.POST("/schedules", cors(addSchedule))
+	router.GET("/schedules/:id", cors(schedule))
+	router.PUT("/schedules/:id", cors(addSchedule))
+	router.DELETE("/schedules/:id", cors(deleteSchedule))
+	router.GET("/schedules/:id/history", cors(scheduleHistory))
+	router.GET("/schedules/:id/history/:count", cors(scheduleHistory))
+	router.GET("/scenes", cors(scenes))
+	router.POST("/scenes", cors(addScene))
+	router.GET("/scenes/:name", cors(getScene))
+	router.PUT("/scenes/:name", cors(addScene))
+	router.DELETE("/scenes/:name", cors(deleteScene))
+	router.POST("/scenes/:name/activate", cors(activateScene))
+
+	metrics.Gauge("home_mqtt_connected", "1 if connected to the broker.", func() float64 {
+		if connection.Status().Connected {
+			return 1
+		}
+		return 0
+	})
+	metrics.Gauge("home_mqtt_subscriptions", "Topic filters subscribed.", func() float64 {
+		return float64(connection.Status().Subscriptions)
+	})
+	metrics.Gauge("home_uptime_seconds", "Time since the service started.", func() float64 {
+		return time.Since(started).Seconds()
+	})
 
+	server = &http.Server{Addr: ":" + cfg.API.Port, Handler: router}
 	go func() {
 		for {
 			fmt.Println("API started...")
-			log.Fatal(http.ListenAndServe(":"+cfg.API.Port, router))
+			err := server.ListenAndServe()
+			if err == http.ErrServerClosed {
+				return
+			}
+			fmt.Println(err)
 			fmt.Println("(╯°□°)╯ API server failed, restarting in...")
 			time.Sleep(5 * time.Second)
 		}
 	}()
 }
+
+// Stop stops the API server, waiting for the requests in progress until the context is done
+func Stop(ctx context.Context) error {
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
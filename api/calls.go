@@ -0,0 +1,238 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/conejoninja/home/command"
+	"github.com/conejoninja/home/common"
+	"github.com/julienschmidt/httprouter"
+)
+
+// callRequest is the JSON body of a call, Wait is the time to wait for the reply of the device, like "5s",
+// and TTL the time the call is kept queued if the device is offline
+type callRequest struct {
+	Device string                 `json:"device,omitempty"`
+	Method string                 `json:"method,omitempty"`
+	Params map[string]interface{} `json:"params"`
+	Wait   string                 `json:"wait,omitempty"`
+	TTL    string                 `json:"ttl,omitempty"`
+}
+
+type batchRequest struct {
+	Calls []callRequest `json:"calls"`
+	Wait  string        `json:"wait,omitempty"`
+	TTL   string        `json:"ttl,omitempty"`
+}
+
+type callResponse struct {
+	Type     string       `json:"type"`
+	Message  string       `json:"message"`
+	Problems []string     `json:"problems,omitempty"`
+	Call     *common.Call `json:"call,omitempty"`
+}
+
+type batchResult struct {
+	Device string `json:"device"`
+	Method string `json:"method"`
+	callResponse
+}
+
+func isJSON(req *http.Request) bool {
+	mediatype, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediatype == "application/json"
+}
+
+// toParams returns the params of a JSON body sorted by name, their values keep their types
+func toParams(params map[string]interface{}) []common.Value {
+	values := make([]common.Value, 0, len(params))
+	for k, v := range params {
+		values = append(values, common.Value{ID: k, Value: v})
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].ID < values[j].ID })
+	return values
+}
+
+func call(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var f common.Method
+	f.Name = ps.ByName("function")
+	var wait, ttl time.Duration
+	if isJSON(req) {
+		var body callRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			res.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"Invalid JSON\"}")
+			return
+		}
+		f.Params = toParams(body.Params)
+		wait, _ = time.ParseDuration(body.Wait)
+		ttl, _ = time.ParseDuration(body.TTL)
+	} else {
+		req.ParseForm()
+		wait, _ = time.ParseDuration(req.Form.Get("wait"))
+		ttl, _ = time.ParseDuration(req.Form.Get("ttl"))
+		f.Params = make([]common.Value, 0, len(req.Form))
+		for k, v := range req.Form {
+			if len(v) > 0 && k != "wait" && k != "ttl" {
+				f.Params = append(f.Params, common.Value{ID: k, Value: v[0]})
+			}
+		}
+	}
+	// wait and ttl could be in the query too
+	if w, err := time.ParseDuration(req.URL.Query().Get("wait")); err == nil {
+		wait = w
+	}
+	if t, err := time.ParseDuration(req.URL.Query().Get("ttl")); err == nil {
+		ttl = t
+	}
+
+	status, response := doCall(ps.ByName("device"), f, wait, ttl)
+	if status != http.StatusOK {
+		res.WriteHeader(status)
+	}
+	valStr, _ := json.Marshal(response)
+	fmt.Fprint(res, string(valStr))
+}
+
+// batchCall calls several methods on several devices, the results are in the same order as the calls
+func batchCall(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var body batchRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || len(body.Calls) == 0 {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"Invalid JSON, expected {\\\"calls\\\":[...]}\"}")
+		return
+	}
+	defaultWait, _ := time.ParseDuration(body.Wait)
+	defaultTTL, _ := time.ParseDuration(body.TTL)
+
+	// calls to the same device are sent in order, only different devices are called in parallel
+	byDevice := make(map[string][]int)
+	var devices []string
+	for k, c := range body.Calls {
+		if _, ok := byDevice[c.Device]; !ok {
+			devices = append(devices, c.Device)
+		}
+		byDevice[c.Device] = append(byDevice[c.Device], k)
+	}
+
+	results := make([]batchResult, len(body.Calls))
+	var wg sync.WaitGroup
+	for _, device := range devices {
+		wg.Add(1)
+		go func(indexes []int) {
+			defer wg.Done()
+			for _, k := range indexes {
+				c := body.Calls[k]
+				wait := defaultWait
+				if w, err := time.ParseDuration(c.Wait); err == nil {
+					wait = w
+				}
+				ttl := defaultTTL
+				if t, err := time.ParseDuration(c.TTL); err == nil {
+					ttl = t
+				}
+				_, response := doCall(c.Device, common.Method{Name: c.Method, Params: toParams(c.Params)}, wait, ttl)
+				results[k] = batchResult{Device: c.Device, Method: c.Method, callResponse: response}
+			}
+		}(byDevice[device])
+	}
+	wg.Wait()
+
+	valStr, _ := json.Marshal(results)
+	fmt.Fprint(res, string(valStr))
+}
+
+// doCall validates and sends a method to a device, and waits for its reply if wait is set
+func doCall(device string, f common.Method, wait, ttl time.Duration) (int, callResponse) {
+	d := db.GetDevice([]byte(device))
+	if d.IsNil() {
+		return http.StatusNotFound, callResponse{Type: "error", Message: "device not found"}
+	}
+	f, problems := command.Validate(d, f)
+	if len(problems) > 0 {
+		return http.StatusBadRequest, callResponse{Type: "error", Message: "invalid call", Problems: problems}
+	}
+
+	var c common.Call
+	var err error
+	if wait > 0 {
+		c, err = command.CallWait(device, f, wait, ttl)
+	} else {
+		c, err = command.Send(device, f, ttl)
+	}
+	if err != nil {
+		return http.StatusOK, callResponse{Type: "error", Message: err.Error(), Call: &c}
+	}
+
+	response := callResponse{Type: "success", Message: "Function called", Call: &c}
+	switch c.Status {
+	case "queued":
+		response.Message = "Device offline, call queued"
+	case "ok":
+		if wait > 0 {
+			response.Message = "Function executed"
+		}
+	case "error":
+		response.Type = "error"
+		response.Message = c.Error
+	case "timeout":
+		response.Type = "error"
+		response.Message = "No reply from the device"
+	}
+	return http.StatusOK, response
+}
+
+func calls(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	count := 10
+	if c, err := strconv.Atoi(ps.ByName("count")); err == nil {
+		count = c
+	}
+
+	valStr, err := json.Marshal(db.GetLastCalls(ps.ByName("device"), count))
+	if err != nil {
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"failed\"}")
+		return
+	}
+
+	fmt.Fprint(res, string(valStr))
+}
+
+func getCall(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	c := db.GetCall(ps.ByName("device"), ps.ByName("id"))
+	if c.ID == "" {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"call not found\"}")
+		return
+	}
+	valStr, _ := json.Marshal(c)
+	fmt.Fprint(res, string(valStr))
+}
+
+func queue(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	queued := db.GetQueued(ps.ByName("device"))
+	if queued == nil {
+		queued = []common.Call{}
+	}
+	valStr, err := json.Marshal(queued)
+	if err != nil {
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"failed\"}")
+		return
+	}
+
+	fmt.Fprint(res, string(valStr))
+}
+
+func cancelQueued(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if err := command.Cancel(ps.ByName("device"), ps.ByName("id")); err != nil {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "{\"type\":\"error\",\"message\":\"%s\"}", err)
+		return
+	}
+	fmt.Fprint(res, "{\"type\":\"success\",\"message\":\"Call cancelled\"}")
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/conejoninja/home/logger"
+	"github.com/julienschmidt/httprouter"
+)
+
+func deadLetters(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	count := 50
+	if c, err := strconv.Atoi(ps.ByName("count")); err == nil {
+		count = c
+	}
+
+	valStr, err := json.Marshal(db.GetLastDeadLetters(count))
+	if err != nil {
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"failed\"}")
+		return
+	}
+
+	fmt.Fprint(res, string(valStr))
+}
+
+func replayDeadLetter(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if err := logger.Replay(ps.ByName("id")); err != nil {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "{\"type\":\"error\",\"message\":\"%s\"}", err)
+		return
+	}
+	fmt.Fprint(res, "{\"type\":\"success\",\"message\":\"Message replayed\"}")
+}
+
+func deleteDeadLetter(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if db.GetDeadLetter(ps.ByName("id")).ID == "" {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"Dead letter not found\"}")
+		return
+	}
+	db.DeleteDeadLetter(ps.ByName("id"))
+	fmt.Fprint(res, "{\"type\":\"success\",\"message\":\"Dead letter deleted\"}")
+}
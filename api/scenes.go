@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/scene"
+	"github.com/julienschmidt/httprouter"
+)
+
+type activateResponse struct {
+	Type    string              `json:"type"`
+	Message string              `json:"message"`
+	Results []common.CallResult `json:"results"`
+}
+
+func scenes(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	scenesjson, err := json.Marshal(db.GetScenes())
+	if err != nil {
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"failed\"}")
+		return
+	}
+
+	fmt.Fprint(res, string(scenesjson))
+}
+
+func getScene(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	s := db.GetScene([]byte(ps.ByName("name")))
+	if s.Name == "" {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"Scene not found\"}")
+		return
+	}
+	scenejson, err := json.Marshal(s)
+	if err != nil {
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"failed\"}")
+		return
+	}
+
+	fmt.Fprint(res, string(scenejson))
+}
+
+func addScene(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var s common.Scene
+	err := json.NewDecoder(req.Body).Decode(&s)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "{\"type\":\"error\",\"message\":%q}", err.Error())
+		return
+	}
+	if name := ps.ByName("name"); name != "" {
+		s.Name = name
+	}
+	if err = scene.Validate(s); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "{\"type\":\"error\",\"message\":%q}", err.Error())
+		return
+	}
+	if err = db.AddScene([]byte(s.Name), s); err != nil {
+		fmt.Fprintf(res, "{\"type\":\"error\",\"message\":%q}", err.Error())
+		return
+	}
+	fmt.Fprint(res, "{\"type\":\"success\",\"message\":\"Scene saved\"}")
+}
+
+func deleteScene(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if db.GetScene([]byte(ps.ByName("name"))).Name == "" {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"Scene not found\"}")
+		return
+	}
+	if err := db.DeleteScene([]byte(ps.ByName("name"))); err != nil {
+		fmt.Fprintf(res, "{\"type\":\"error\",\"message\":%q}", err.Error())
+		return
+	}
+	fmt.Fprint(res, "{\"type\":\"success\",\"message\":\"Scene deleted\"}")
+}
+
+func activateScene(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	results, err := scene.Activate(ps.ByName("name"))
+	response := activateResponse{
+		Type:    "success",
+		Message: "Scene activated",
+		Results: results,
+	}
+	if err != nil {
+		response.Type = "error"
+		response.Message = err.Error()
+		if results == nil {
+			res.WriteHeader(http.StatusNotFound)
+		} else {
+			// some of the calls to the devices failed
+			res.WriteHeader(http.StatusBadGateway)
+		}
+	}
+
+	valStr, _ := json.Marshal(response)
+	fmt.Fprint(res, string(valStr))
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/scheduler"
+	"github.com/julienschmidt/httprouter"
+)
+
+func schedules(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	schedulesjson, err := json.Marshal(db.GetSchedules())
+	if err != nil {
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"failed\"}")
+		return
+	}
+
+	fmt.Fprint(res, string(schedulesjson))
+}
+
+func schedule(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	s := db.GetSchedule([]byte(ps.ByName("id")))
+	if s.ID == "" {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"Schedule not found\"}")
+		return
+	}
+	schedulejson, err := json.Marshal(s)
+	if err != nil {
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"failed\"}")
+		return
+	}
+
+	fmt.Fprint(res, string(schedulejson))
+}
+
+func addSchedule(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var s common.Schedule
+	err := json.NewDecoder(req.Body).Decode(&s)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "{\"type\":\"error\",\"message\":%q}", err.Error())
+		return
+	}
+	id := ps.ByName("id")
+	if id != "" {
+		if db.GetSchedule([]byte(id)).ID == "" {
+			res.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"Schedule not found\"}")
+			return
+		}
+		s.ID = id
+	}
+	if err = scheduler.Validate(s); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "{\"type\":\"error\",\"message\":%q}", err.Error())
+		return
+	}
+	// a new schedule can't replace an existing one, that's what PUT is for
+	if id == "" && db.GetSchedule([]byte(s.ID)).ID != "" {
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"Schedule already exists\"}")
+		return
+	}
+	if err = db.AddSchedule([]byte(s.ID), s); err != nil {
+		fmt.Fprintf(res, "{\"type\":\"error\",\"message\":%q}", err.Error())
+		return
+	}
+	fmt.Fprint(res, "{\"type\":\"success\",\"message\":\"Schedule saved\"}")
+}
+
+func deleteSchedule(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if db.GetSchedule([]byte(ps.ByName("id"))).ID == "" {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"Schedule not found\"}")
+		return
+	}
+	if err := db.DeleteSchedule([]byte(ps.ByName("id"))); err != nil {
+		fmt.Fprintf(res, "{\"type\":\"error\",\"message\":%q}", err.Error())
+		return
+	}
+	fmt.Fprint(res, "{\"type\":\"success\",\"message\":\"Schedule deleted\"}")
+}
+
+func scheduleHistory(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	count := 10
+	if c, err := strconv.Atoi(ps.ByName("count")); err == nil {
+		count = c
+	}
+
+	evtjson, err := json.Marshal(db.GetLastEvents("schedule-"+ps.ByName("id"), count))
+	if err != nil {
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"failed\"}")
+		return
+	}
+
+	fmt.Fprint(res, string(evtjson))
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/conejoninja/home/shadow"
+	"github.com/julienschmidt/httprouter"
+)
+
+// shadowRequest is the body of a patch, a null value removes it from the desired state
+type shadowRequest struct {
+	Desired map[string]interface{} `json:"desired"`
+}
+
+func getShadow(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	device := db.GetDevice([]byte(ps.ByName("id")))
+	if device.IsNil() {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"Device not found\"}")
+		return
+	}
+	shadowjson, err := json.Marshal(shadow.Get(ps.ByName("id")))
+	if err != nil {
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"failed\"}")
+		return
+	}
+
+	fmt.Fprint(res, string(shadowjson))
+}
+
+func patchShadow(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var body shadowRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Desired == nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"Invalid JSON, expected {\\\"desired\\\":{...}}\"}")
+		return
+	}
+	device := db.GetDevice([]byte(ps.ByName("id")))
+	if device.IsNil() {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(res, "{\"type\":\"error\",\"message\":\"Device not found\"}")
+		return
+	}
+	if err := shadow.Validate(device, body.Desired); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "{\"type\":\"error\",\"message\":%q}", err.Error())
+		return
+	}
+
+	s, err := shadow.Patch(ps.ByName("id"), body.Desired)
+	if err != nil {
+		fmt.Fprintf(res, "{\"type\":\"error\",\"message\":\"%s\"}", err)
+		return
+	}
+	shadowjson, _ := json.Marshal(s)
+	fmt.Fprint(res, string(shadowjson))
+}
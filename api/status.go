@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/connection"
+	"github.com/conejoninja/home/logger"
+	"github.com/conejoninja/home/telegram"
+	"github.com/julienschmidt/httprouter"
+)
+
+var started = time.Now()
+
+type healthResponse struct {
+	Status   string   `json:"status"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// problems returns why the service is not ready, MQTT or the storage being down. Probing the storage
+// writes to it, so it's done once by the caller
+func problems(storageOpen bool) []string {
+	var p []string
+	if !connection.Status().Connected {
+		p = append(p, "MQTT disconnected")
+	}
+	if !storageOpen {
+		p = append(p, "storage closed")
+	}
+	return p
+}
+
+// health answers 503 if the service is not ready
+func health(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	response := healthResponse{Status: "ok", Problems: problems(db.IsOpen())}
+	if len(response.Problems) > 0 {
+		response.Status = "unavailable"
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}
+	valStr, _ := json.Marshal(response)
+	fmt.Fprint(res, string(valStr))
+}
+
+func status(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	open := db.IsOpen()
+	response := common.Status{
+		Status:    "ok",
+		Problems:  problems(open),
+		Started:   &started,
+		Uptime:    time.Since(started).Truncate(time.Second).String(),
+		MQTT:      connection.Status(),
+		Ingestion: logger.Ingestion(),
+		Storage: common.StorageStatus{
+			Open: open,
+			Size: db.Size(),
+		},
+		Telegram: common.TelegramStatus{
+			Enabled:   cfg.Tg.Enabled,
+			Connected: telegram.Connected(),
+		},
+	}
+	if len(response.Problems) > 0 {
+		response.Status = "unavailable"
+	}
+	valStr, _ := json.Marshal(response)
+	fmt.Fprint(res, string(valStr))
+}
+
+// HealthCheck asks the health of a running service to its API, for the health check of Docker
+func HealthCheck(homecfg common.HomeConfig) error {
+	client := http.Client{Timeout: 5 * time.Second}
+	res, err := client.Get("http://localhost:" + homecfg.API.Port + "/health")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var response healthResponse
+		json.NewDecoder(res.Body).Decode(&response)
+		return fmt.Errorf("%s %v", response.Status, response.Problems)
+	}
+	return nil
+}
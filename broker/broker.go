@@ -0,0 +1,62 @@
+package broker
+
+import (
+	"fmt"
+
+	"github.com/conejoninja/home/common"
+	mqtt "github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/hooks/auth"
+	"github.com/mochi-co/mqtt/v2/listeners"
+)
+
+var server *mqtt.Server
+
+// Start runs the embedded broker with a TCP and a websocket listener. Every client needs the
+// configured user and password, if there's any
+func Start(homecfg common.HomeConfig) error {
+	cfg := homecfg.Broker
+	server = mqtt.New(nil)
+
+	var err error
+	if cfg.User != "" {
+		err = server.AddHook(new(auth.Hook), &auth.Options{
+			Ledger: &auth.Ledger{
+				Auth: auth.AuthRules{
+					{Username: auth.RString(cfg.User), Password: auth.RString(cfg.Password), Allow: true},
+				},
+			},
+		})
+	} else {
+		err = server.AddHook(new(auth.AllowHook), nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = server.AddListener(listeners.NewTCP("tcp", ":"+cfg.Port, nil)); err != nil {
+		return err
+	}
+	if cfg.WSPort != "" {
+		if err = server.AddListener(listeners.NewWebsocket("ws", ":"+cfg.WSPort, nil)); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		if err := server.Serve(); err != nil {
+			fmt.Println("Embedded broker failed:", err)
+		}
+	}()
+	fmt.Println("Embedded broker started on:", cfg.Port, cfg.WSPort)
+	return nil
+}
+
+// Stop closes the listeners and the connections of the clients
+func Stop() {
+	if server == nil {
+		return
+	}
+	if err := server.Close(); err != nil {
+		fmt.Println("Error stopping the embedded broker:", err)
+	}
+}
@@ -1,16 +1,27 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"time"
 
 	"github.com/conejoninja/home/api"
+	"github.com/conejoninja/home/broker"
+	"github.com/conejoninja/home/command"
 	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/connection"
+	"github.com/conejoninja/home/homeassistant"
 	"github.com/conejoninja/home/logger"
+	"github.com/conejoninja/home/rules"
+	"github.com/conejoninja/home/scene"
+	"github.com/conejoninja/home/scheduler"
+	"github.com/conejoninja/home/shadow"
 	"github.com/conejoninja/home/storage"
 	"github.com/conejoninja/home/telegram"
 	"github.com/eclipse/paho.mqtt.golang"
@@ -27,6 +38,15 @@ var mqttclient mqtt.Client
 func main() {
 	cfg := readConfig()
 
+	// "home healthcheck" asks the running service if it's ready, and exits
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		if err := api.HealthCheck(cfg); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	db = storage.NewBadger(cfg.DBPath)
 
 	opts := mqtt.NewClientOptions().AddBroker(cfg.MQTT.Protocol + "://" + cfg.MQTT.Server + ":" + cfg.MQTT.Port)
@@ -37,30 +57,100 @@ func main() {
 	if cfg.MQTT.Password != "" {
 		opts.SetPassword(cfg.MQTT.Password)
 	}
-	//opts.SetDefaultPublishHandler(defaultHandler)
+	// the messages the broker kept for a persistent session arrive before the subscriptions are
+	// restored, the routes of every subscription take them and the rest go to the default handler
+	opts.SetDefaultPublishHandler(connection.DefaultHandler)
+	opts.SetCleanSession(!cfg.MQTT.PersistentSession)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(time.Minute)
+	opts.SetOnConnectHandler(connection.OnConnect)
+	opts.SetConnectionLostHandler(connection.OnConnectionLost)
 
-	mqttclient = mqtt.NewClient(opts)
-	if token = mqttclient.Connect(); token.Wait() && token.Error() != nil {
-		fmt.Println(token.Error())
-		panic(token.Error())
+	if cfg.Broker.Enabled {
+		if err := broker.Start(cfg); err != nil {
+			fmt.Println(err)
+			panic(err)
+		}
 	}
 
+	mqttclient = mqtt.NewClient(opts)
+	connection.Start(cfg, mqttclient)
+
+	// every subscription is registered before connecting, so no message is left without a handler
+	command.Start(cfg, db, mqttclient)
+	scene.Start(db)
+
 	if cfg.API.Enabled {
-		api.Start(cfg, db, mqttclient)
+		api.Start(cfg, db)
 	}
 	if cfg.Tg.Enabled {
 		telegram.Start(cfg)
 	}
+	rules.Start(cfg, db)
+	scheduler.Start(cfg, db)
+	shadow.Start(cfg, db)
+	homeassistant.Start(cfg, db)
 	logger.Start(cfg, db, mqttclient)
 
-	for {
-		fmt.Println(time.Now(), "Still alive")
-		time.Sleep(5 * time.Minute)
+	// the broker could still be starting, keep trying instead of giving up
+	backoff := time.Second
+	for token = mqttclient.Connect(); token.Wait() && token.Error() != nil; token = mqttclient.Connect() {
+		fmt.Println(token.Error(), "retrying in", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	alive := time.NewTicker(5 * time.Minute)
+	for {
+		select {
+		case <-alive.C:
+			ingestion := logger.Ingestion()
+			fmt.Println(time.Now(), "Still alive, MQTT connected:", connection.Status().Connected, "messages:", ingestion.Messages)
+		case sig := <-signals:
+			fmt.Println(time.Now(), "Received", sig, "shutting down")
+			alive.Stop()
+			shutdown(cfg)
+			return
+		}
 	}
 
 }
 
+// shutdown stops every subsystem, the servers first so nothing new comes in, and the storage last
+func shutdown(cfg common.HomeConfig) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if cfg.API.Enabled {
+		if err := api.Stop(ctx); err != nil {
+			fmt.Println("Error stopping the API:", err)
+		}
+	}
+	if cfg.Tg.Enabled {
+		telegram.Stop()
+	}
+	// the background loops use the broker and the storage, they go before them
+	scheduler.Stop()
+	shadow.Stop()
+	command.Stop()
+	connection.Stop(cfg.ShutdownTimeout)
+	if err := logger.Stop(ctx); err != nil {
+		fmt.Println("Error stopping the websocket server:", err)
+	}
+	if cfg.Broker.Enabled {
+		broker.Stop()
+	}
+	if err := db.Close(); err != nil {
+		fmt.Println("Error closing the storage:", err)
+	}
+	fmt.Println(time.Now(), "Bye")
+}
+
 func readConfig() (cfg common.HomeConfig) {
 	if _, err := os.Stat("./config.yml"); err != nil {
 		fmt.Println("Error: config.yml file does not exist")
@@ -129,6 +219,105 @@ func readConfig() (cfg common.HomeConfig) {
 		cfg.MQTT.ClientID = "home-cmd"
 	}
 
+	/**
+	 * EMBEDDED BROKER
+	 */
+	broker_enabled_str := os.Getenv("BROKER_ENABLED")
+	cfg.Broker.Port = os.Getenv("BROKER_PORT")
+	cfg.Broker.WSPort = os.Getenv("BROKER_WS_PORT")
+	cfg.Broker.User = os.Getenv("BROKER_USER")
+	cfg.Broker.Password = os.Getenv("BROKER_PASSWORD")
+	if broker_enabled_str == "" {
+		broker_enabled_str = fmt.Sprint(viper.Get("broker_enabled"))
+	}
+	if cfg.Broker.Port == "" {
+		cfg.Broker.Port = viper.GetString("broker_port")
+	}
+	if cfg.Broker.WSPort == "" {
+		cfg.Broker.WSPort = viper.GetString("broker_ws_port")
+	}
+	if cfg.Broker.User == "" {
+		cfg.Broker.User = viper.GetString("broker_user")
+	}
+	if cfg.Broker.Password == "" {
+		cfg.Broker.Password = viper.GetString("broker_password")
+	}
+
+	cfg.Broker.Enabled = false
+	if broker_enabled_str == "1" || broker_enabled_str == "true" {
+		cfg.Broker.Enabled = true
+	}
+	if cfg.Broker.Port == "" {
+		cfg.Broker.Port = "1883"
+	}
+	// the service is a client of its own broker
+	if cfg.Broker.Enabled {
+		cfg.MQTT.Protocol = "tcp"
+		cfg.MQTT.Server = "localhost"
+		cfg.MQTT.Port = cfg.Broker.Port
+		cfg.MQTT.User = cfg.Broker.User
+		cfg.MQTT.Password = cfg.Broker.Password
+	}
+
+	cfg.MQTT.DiscoveryTopic = os.Getenv("MQTT_TOPIC_DISCOVERY")
+	cfg.MQTT.EventsTopic = os.Getenv("MQTT_TOPIC_EVENTS")
+	cfg.MQTT.ValuesTopic = os.Getenv("MQTT_TOPIC_VALUES")
+	cfg.MQTT.CallTopic = os.Getenv("MQTT_TOPIC_CALL")
+	if cfg.MQTT.DiscoveryTopic == "" {
+		cfg.MQTT.DiscoveryTopic = viper.GetString("mqtt_topic_discovery")
+	}
+	if cfg.MQTT.EventsTopic == "" {
+		cfg.MQTT.EventsTopic = viper.GetString("mqtt_topic_events")
+	}
+	if cfg.MQTT.ValuesTopic == "" {
+		cfg.MQTT.ValuesTopic = viper.GetString("mqtt_topic_values")
+	}
+	if cfg.MQTT.CallTopic == "" {
+		cfg.MQTT.CallTopic = viper.GetString("mqtt_topic_call")
+	}
+	if cfg.MQTT.DiscoveryTopic == "" {
+		cfg.MQTT.DiscoveryTopic = "discovery"
+	}
+	if cfg.MQTT.EventsTopic == "" {
+		cfg.MQTT.EventsTopic = "events"
+	}
+	if !strings.Contains(cfg.MQTT.ValuesTopic, common.DevicePlaceholder) {
+		cfg.MQTT.ValuesTopic = common.DevicePlaceholder
+	}
+	if !strings.Contains(cfg.MQTT.CallTopic, common.DevicePlaceholder) {
+		cfg.MQTT.CallTopic = common.DevicePlaceholder + "-call"
+	}
+	cfg.MQTT.AvailabilityTopic = os.Getenv("MQTT_TOPIC_AVAILABILITY")
+	if cfg.MQTT.AvailabilityTopic == "" {
+		cfg.MQTT.AvailabilityTopic = viper.GetString("mqtt_topic_availability")
+	}
+	if !strings.Contains(cfg.MQTT.AvailabilityTopic, common.DevicePlaceholder) {
+		cfg.MQTT.AvailabilityTopic = common.DevicePlaceholder + "/availability"
+	}
+	cfg.MQTT.ReplyTopic = os.Getenv("MQTT_TOPIC_REPLY")
+	if cfg.MQTT.ReplyTopic == "" {
+		cfg.MQTT.ReplyTopic = viper.GetString("mqtt_topic_reply")
+	}
+	if !strings.Contains(cfg.MQTT.ReplyTopic, common.DevicePlaceholder) {
+		cfg.MQTT.ReplyTopic = common.DevicePlaceholder + "/reply"
+	}
+	// the devices of these topics are subscribed to with a wildcard
+	for _, template := range []string{cfg.MQTT.ValuesTopic, cfg.MQTT.AvailabilityTopic, cfg.MQTT.ReplyTopic} {
+		if err := common.CheckTemplate(template); err != nil {
+			fmt.Println("Error in the MQTT topics:", err)
+			os.Exit(1)
+		}
+	}
+
+	mqtt_persistent_str := os.Getenv("MQTT_PERSISTENT_SESSION")
+	if mqtt_persistent_str == "" {
+		mqtt_persistent_str = fmt.Sprint(viper.Get("mqtt_persistent_session"))
+	}
+	cfg.MQTT.PersistentSession = false
+	if mqtt_persistent_str == "1" || mqtt_persistent_str == "true" {
+		cfg.MQTT.PersistentSession = true
+	}
+
 	/**
 	 * API
 	 */
@@ -200,5 +389,235 @@ func readConfig() (cfg common.HomeConfig) {
 		}
 		cfg.Tg.Chats[k] = int64(i)
 	}
+
+	/**
+	 * HOME ASSISTANT
+	 */
+	ha_enabled_str := os.Getenv("HA_ENABLED")
+	cfg.HA.Prefix = os.Getenv("HA_PREFIX")
+	if ha_enabled_str == "" {
+		ha_enabled_str = fmt.Sprint(viper.Get("ha_enabled"))
+	}
+	if cfg.HA.Prefix == "" {
+		cfg.HA.Prefix = viper.GetString("ha_prefix")
+	}
+
+	cfg.HA.Enabled = false
+	if ha_enabled_str == "1" || ha_enabled_str == "true" {
+		cfg.HA.Enabled = true
+	}
+	if cfg.HA.Prefix == "" {
+		cfg.HA.Prefix = "homeassistant"
+	}
+
+	/**
+	 * HOMIE
+	 */
+	homie_enabled_str := os.Getenv("HOMIE_ENABLED")
+	cfg.Homie.Prefix = os.Getenv("HOMIE_PREFIX")
+	if homie_enabled_str == "" {
+		homie_enabled_str = fmt.Sprint(viper.Get("homie_enabled"))
+	}
+	if cfg.Homie.Prefix == "" {
+		cfg.Homie.Prefix = viper.GetString("homie_prefix")
+	}
+
+	cfg.Homie.Enabled = false
+	if homie_enabled_str == "1" || homie_enabled_str == "true" {
+		cfg.Homie.Enabled = true
+	}
+	if cfg.Homie.Prefix == "" {
+		cfg.Homie.Prefix = "homie"
+	}
+
+	/**
+	 * ALERTS
+	 */
+	alerts_hysteresis_str := os.Getenv("ALERTS_HYSTERESIS")
+	alerts_debounce_str := os.Getenv("ALERTS_DEBOUNCE")
+	if alerts_hysteresis_str == "" {
+		alerts_hysteresis_str = fmt.Sprint(viper.Get("alerts_hysteresis"))
+	}
+	if alerts_debounce_str == "" {
+		alerts_debounce_str = fmt.Sprint(viper.Get("alerts_debounce"))
+	}
+
+	cfg.Alerts.Hysteresis, err = strconv.ParseFloat(alerts_hysteresis_str, 64)
+	if err != nil {
+		cfg.Alerts.Hysteresis = 0
+	}
+	cfg.Alerts.Debounce, err = time.ParseDuration(alerts_debounce_str)
+	if err != nil {
+		cfg.Alerts.Debounce = 0
+	}
+	cfg.Alerts.Thresholds = make(map[string]common.Threshold)
+	if err = viper.UnmarshalKey("thresholds", &cfg.Alerts.Thresholds); err != nil {
+		fmt.Println("Error reading thresholds:", err)
+	}
+
+	/**
+	 * ANOMALY DETECTION
+	 */
+	anomaly_enabled_str := os.Getenv("ANOMALY_ENABLED")
+	cfg.Anomaly.Method = os.Getenv("ANOMALY_METHOD")
+	anomaly_threshold_str := os.Getenv("ANOMALY_THRESHOLD")
+	anomaly_days_str := os.Getenv("ANOMALY_DAYS")
+	if anomaly_enabled_str == "" {
+		anomaly_enabled_str = fmt.Sprint(viper.Get("anomaly_enabled"))
+	}
+	if cfg.Anomaly.Method == "" {
+		cfg.Anomaly.Method = fmt.Sprint(viper.Get("anomaly_method"))
+	}
+	if anomaly_threshold_str == "" {
+		anomaly_threshold_str = fmt.Sprint(viper.Get("anomaly_threshold"))
+	}
+	if anomaly_days_str == "" {
+		anomaly_days_str = fmt.Sprint(viper.Get("anomaly_days"))
+	}
+
+	cfg.Anomaly.Enabled = false
+	if anomaly_enabled_str == "1" || anomaly_enabled_str == "true" {
+		cfg.Anomaly.Enabled = true
+	}
+	if cfg.Anomaly.Method != "mad" {
+		cfg.Anomaly.Method = "zscore"
+	}
+	cfg.Anomaly.Threshold, err = strconv.ParseFloat(anomaly_threshold_str, 64)
+	if err != nil || cfg.Anomaly.Threshold <= 0 {
+		cfg.Anomaly.Threshold = 4
+	}
+	cfg.Anomaly.Days, err = strconv.Atoi(anomaly_days_str)
+	if err != nil || cfg.Anomaly.Days <= 0 {
+		cfg.Anomaly.Days = 14
+	}
+
+	/**
+	 * DECODERS
+	 */
+	cfg.Decoders = make(map[string]string)
+	if err = viper.UnmarshalKey("decoders", &cfg.Decoders); err != nil {
+		fmt.Println("Error reading decoders:", err)
+	}
+
+	/**
+	 * VALIDATION
+	 */
+	cfg.Validation = os.Getenv("VALIDATION_POLICY")
+	if cfg.Validation == "" {
+		cfg.Validation = fmt.Sprint(viper.Get("validation_policy"))
+	}
+	if cfg.Validation != "tag" && cfg.Validation != "quarantine" {
+		cfg.Validation = "accept"
+	}
+
+	/**
+	 * CALLS
+	 */
+	call_ttl_str := os.Getenv("CALL_TTL")
+	if call_ttl_str == "" {
+		call_ttl_str = fmt.Sprint(viper.Get("call_ttl"))
+	}
+	cfg.CallTTL, err = time.ParseDuration(call_ttl_str)
+	if err != nil || cfg.CallTTL <= 0 {
+		cfg.CallTTL = 24 * time.Hour
+	}
+	seen_timeout_str := os.Getenv("SEEN_TIMEOUT")
+	if seen_timeout_str == "" {
+		seen_timeout_str = fmt.Sprint(viper.Get("seen_timeout"))
+	}
+	cfg.SeenTimeout, err = time.ParseDuration(seen_timeout_str)
+	if err != nil || cfg.SeenTimeout <= 0 {
+		cfg.SeenTimeout = 15 * time.Minute
+	}
+
+	/**
+	 * SHADOW
+	 */
+	shadow_retry_str := os.Getenv("SHADOW_RETRY")
+	if shadow_retry_str == "" {
+		shadow_retry_str = fmt.Sprint(viper.Get("shadow_retry"))
+	}
+	cfg.ShadowRetry, err = time.ParseDuration(shadow_retry_str)
+	if err != nil || cfg.ShadowRetry <= 0 {
+		cfg.ShadowRetry = time.Minute
+	}
+	shadow_attempts_str := os.Getenv("SHADOW_ATTEMPTS")
+	if shadow_attempts_str == "" {
+		shadow_attempts_str = fmt.Sprint(viper.Get("shadow_attempts"))
+	}
+	cfg.ShadowAttempts, err = strconv.Atoi(shadow_attempts_str)
+	if err != nil || cfg.ShadowAttempts <= 0 {
+		cfg.ShadowAttempts = 10
+	}
+
+	/**
+	 * DEAD LETTERS
+	 */
+	deadletters_str := os.Getenv("DEADLETTERS_MAX")
+	if deadletters_str == "" {
+		deadletters_str = fmt.Sprint(viper.Get("deadletters_max"))
+	}
+	cfg.DeadLetters, err = strconv.Atoi(deadletters_str)
+	if err != nil || cfg.DeadLetters < 0 {
+		cfg.DeadLetters = 1000
+	}
+
+	/**
+	 * SHUTDOWN
+	 */
+	shutdown_timeout_str := os.Getenv("SHUTDOWN_TIMEOUT")
+	if shutdown_timeout_str == "" {
+		shutdown_timeout_str = fmt.Sprint(viper.Get("shutdown_timeout"))
+	}
+	cfg.ShutdownTimeout, err = time.ParseDuration(shutdown_timeout_str)
+	if err != nil || cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = 10 * time.Second
+	}
+
+	/**
+	 * DEADBAND
+	 */
+	cfg.Deadband = make(map[string]common.Deadband)
+	if err = viper.UnmarshalKey("deadband", &cfg.Deadband); err != nil {
+		fmt.Println("Error reading deadband:", err)
+	}
+
+	/**
+	 * VIRTUAL SENSORS
+	 */
+	if err = viper.UnmarshalKey("virtual_sensors", &cfg.Virtual); err != nil {
+		fmt.Println("Error reading virtual sensors:", err)
+	}
+
+	/**
+	 * RULES
+	 */
+	cfg.RulesFile = os.Getenv("RULES_FILE")
+	if cfg.RulesFile == "" {
+		cfg.RulesFile = fmt.Sprint(viper.Get("rules_file"))
+	}
+	if cfg.RulesFile == "" || cfg.RulesFile == "<nil>" {
+		cfg.RulesFile = "./rules.yml"
+	}
+
+	/**
+	 * SCHEDULER
+	 */
+	latitude_str := os.Getenv("LATITUDE")
+	longitude_str := os.Getenv("LONGITUDE")
+	if latitude_str == "" {
+		latitude_str = fmt.Sprint(viper.Get("latitude"))
+	}
+	if longitude_str == "" {
+		longitude_str = fmt.Sprint(viper.Get("longitude"))
+	}
+	cfg.Latitude, err = strconv.ParseFloat(latitude_str, 64)
+	if err != nil {
+		fmt.Println("Latitude not set, sunrise and sunset schedules will not be accurate")
+	}
+	cfg.Longitude, err = strconv.ParseFloat(longitude_str, 64)
+	if err != nil {
+		fmt.Println("Longitude not set, sunrise and sunset schedules will not be accurate")
+	}
 	return
 }
@@ -0,0 +1,229 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/connection"
+	"github.com/conejoninja/home/storage"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var c mqtt.Client
+var cfg common.HomeConfig
+var db storage.Storage
+
+// Handler sends a method to a device that doesn't listen on the call topic
+type Handler func(device string, method common.Method) error
+
+var handlers = make(map[string]Handler)
+var handlersMutex sync.Mutex
+
+// last ID given to a call
+var lastID int64
+var idMutex sync.Mutex
+
+// calls waiting for the reply of the device, by device and ID
+var waiting = make(map[string]chan common.Call)
+var waitingMutex sync.Mutex
+
+// Start sets the MQTT client used to reach the devices, and listens to their replies
+func Start(homecfg common.HomeConfig, dbcon storage.Storage, mqttclient mqtt.Client) {
+	cfg = homecfg
+	db = dbcon
+	c = mqttclient
+
+	connection.Subscribe(map[string]byte{common.WildcardTopic(cfg.MQTT.ReplyTopic): connection.QoS()}, replyHandler)
+
+	for _, call := range db.GetAllQueued() {
+		queued[call.Device] = true
+	}
+	connection.AddConnectHandler(flushAll)
+	go expireLoop()
+}
+
+// Handle routes the calls to a device through a handler instead of its call topic
+func Handle(device string, handler Handler) {
+	handlersMutex.Lock()
+	handlers[device] = handler
+	handlersMutex.Unlock()
+}
+
+// Call sends a method to the call topic of a device
+func Call(device string, method common.Method) error {
+	_, err := send(device, method, nil, 0)
+	return err
+}
+
+// Send sends a method to a device without waiting for its reply, and returns the stored call. The call is
+// queued for ttl (or the default one if 0) if the device is offline
+func Send(device string, method common.Method, ttl time.Duration) (common.Call, error) {
+	return send(device, method, nil, ttl)
+}
+
+// CallWait sends a method to a device and waits for its reply, the call has the timeout status if the
+// device doesn't reply in time. Queued calls are returned right away
+func CallWait(device string, method common.Method, timeout, ttl time.Duration) (common.Call, error) {
+	reply := make(chan common.Call, 1)
+	call, err := send(device, method, reply, ttl)
+	if err != nil || call.Status != "pending" {
+		return call, err
+	}
+
+	select {
+	case call = <-reply:
+	case <-time.After(timeout):
+		waitingMutex.Lock()
+		delete(waiting, device+"-"+call.ID)
+		waitingMutex.Unlock()
+		// a reply could still arrive later, and update the stored call
+		stored := db.GetCall(device, call.ID)
+		if stored.Status != "pending" {
+			return stored, nil
+		}
+		call.Status = "timeout"
+		db.AddCall(call)
+	}
+	return call, nil
+}
+
+// send publishes a method with a new correlation ID and stores the call, reply receives the reply of the
+// device. The call is queued instead if the device or the broker are not reachable
+func send(device string, method common.Method, reply chan common.Call, ttl time.Duration) (common.Call, error) {
+	now := time.Now()
+	if ttl <= 0 {
+		ttl = cfg.CallTTL
+	}
+	expires := now.Add(ttl)
+	method.ID = nextID(now)
+	method.ReplyTo = common.DeviceTopic(cfg.MQTT.ReplyTopic, device)
+	call := common.Call{
+		ID:      method.ID,
+		Device:  device,
+		Method:  method,
+		Status:  "pending",
+		Sent:    &now,
+		Expires: &expires,
+	}
+	if _, ok := handler(device); ok {
+		// the handlers can't reply, the call is done once it's sent
+		call.Method.ReplyTo = ""
+	}
+
+	if !isReachable(device) || !connection.Status().Connected {
+		return call, enqueue(call)
+	}
+
+	if reply != nil {
+		waitingMutex.Lock()
+		waiting[device+"-"+call.ID] = reply
+		waitingMutex.Unlock()
+	}
+	db.AddCall(call)
+	replies, err := dispatch(device, call.Method)
+	if err != nil || !replies {
+		waitingMutex.Lock()
+		delete(waiting, device+"-"+call.ID)
+		waitingMutex.Unlock()
+	}
+	if err != nil {
+		call.Status = "failed"
+		call.Error = err.Error()
+		db.AddCall(call)
+		return call, err
+	}
+	if !replies {
+		call.Status = "ok"
+		db.AddCall(call)
+	}
+	return call, nil
+}
+
+// nextID returns a new ID for a call, its time in nanoseconds made unique so two calls in the same
+// clock tick don't share it
+func nextID(now time.Time) string {
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	id := now.UnixNano()
+	if id <= lastID {
+		id = lastID + 1
+	}
+	lastID = id
+	return strconv.FormatInt(id, 10)
+}
+
+func handler(device string) (Handler, bool) {
+	handlersMutex.Lock()
+	defer handlersMutex.Unlock()
+	h, ok := handlers[device]
+	return h, ok
+}
+
+// dispatch sends a method to a device through its handler or its call topic, replies is false if the
+// device can't reply to it
+func dispatch(device string, method common.Method) (replies bool, err error) {
+	if h, ok := handler(device); ok {
+		return false, h(device, method)
+	}
+	methodStr, err := json.Marshal(method)
+	if err != nil {
+		return true, err
+	}
+	return true, Publish(common.DeviceTopic(cfg.MQTT.CallTopic, device), "["+string(methodStr)+"]", false)
+}
+
+// replyHandler stores the replies of the devices and hands them to the calls waiting for them
+var replyHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	device, ok := common.TopicDevice(cfg.MQTT.ReplyTopic, msg.Topic())
+	if !ok {
+		return
+	}
+	var reply common.Reply
+	if err := json.Unmarshal(msg.Payload(), &reply); err != nil || reply.ID == "" {
+		fmt.Println("Invalid reply from", device, string(msg.Payload()))
+		return
+	}
+	call := db.GetCall(device, reply.ID)
+	if call.ID == "" {
+		return
+	}
+	now := time.Now()
+	call.Replied = &now
+	call.Result = reply.Result
+	call.Status = "ok"
+	if reply.Error != "" {
+		call.Status = "error"
+		call.Error = reply.Error
+	}
+	db.AddCall(call)
+
+	waitingMutex.Lock()
+	ch, ok := waiting[device+"-"+call.ID]
+	delete(waiting, device+"-"+call.ID)
+	waitingMutex.Unlock()
+	if ok {
+		ch <- call
+	}
+}
+
+// Publish sends a payload to a topic, waiting for the client to reconnect to the broker if needed
+func Publish(topic, payload string, retained bool) error {
+	backoff := time.Second
+	for tries := 0; tries < 5; tries++ {
+		token := c.Publish(topic, connection.QoS(), retained, payload)
+		if token.WaitTimeout(10*time.Second) && token.Error() == nil {
+			return nil
+		}
+		if token.Error() != nil {
+			fmt.Println(token.Error())
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return errors.New("Not connected")
+}
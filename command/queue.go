@@ -0,0 +1,197 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/conejoninja/home/common"
+)
+
+// devices known to be offline, when every device was last seen, and devices with queued calls
+var offline = make(map[string]bool)
+var seen = make(map[string]time.Time)
+var queued = make(map[string]bool)
+var flushing = make(map[string]bool)
+var queueMutex sync.Mutex
+
+// once stopping no calls are delivered from the queues, flushes waits for the ones in progress
+var stopping bool
+var flushes sync.WaitGroup
+var stop = make(chan struct{})
+var stopped = make(chan struct{})
+
+// Online marks a device as reachable, and delivers its queued calls. It's called for every value and
+// availability message of the device
+func Online(device string) {
+	queueMutex.Lock()
+	delete(offline, device)
+	seen[device] = time.Now()
+	pending := queued[device]
+	queueMutex.Unlock()
+	if pending {
+		go flush(device)
+	}
+}
+
+// Offline marks a device as unreachable, its calls are queued until it's online again
+func Offline(device string) {
+	queueMutex.Lock()
+	offline[device] = true
+	queueMutex.Unlock()
+}
+
+func isReachable(device string) bool {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	return reachable(device)
+}
+
+// reachable checks a device could get its calls now. The devices that don't report their availability
+// have to be seen recently, otherwise their calls wait until they send something. queueMutex is held
+func reachable(device string) bool {
+	if offline[device] {
+		return false
+	}
+	if db.GetDevice([]byte(device)).Availability != "" {
+		return true
+	}
+	last, ok := seen[device]
+	return ok && time.Since(last) < cfg.SeenTimeout
+}
+
+// enqueue stores a call to deliver it once the device is online
+func enqueue(call common.Call) error {
+	call.Status = "queued"
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	db.AddCall(call)
+	if err := db.AddQueued(call); err != nil {
+		return err
+	}
+	queued[call.Device] = true
+	return nil
+}
+
+// flush delivers the queued calls of a device in order, the expired ones are dropped
+func flush(device string) {
+	queueMutex.Lock()
+	if !reachable(device) || flushing[device] || stopping {
+		queueMutex.Unlock()
+		return
+	}
+	flushing[device] = true
+	flushes.Add(1)
+	defer flushes.Done()
+	calls := db.GetQueued(device)
+	queueMutex.Unlock()
+
+	for _, call := range calls {
+		queueMutex.Lock()
+		// it could have been cancelled, the device gone offline again, or we're stopping
+		if !reachable(device) || stopping {
+			queueMutex.Unlock()
+			break
+		}
+		if db.GetCall(device, call.ID).Status != "queued" {
+			queueMutex.Unlock()
+			continue
+		}
+		db.DeleteQueued(device, call.ID)
+		now := time.Now()
+		if call.Expires != nil && now.After(*call.Expires) {
+			call.Status = "expired"
+			db.AddCall(call)
+			queueMutex.Unlock()
+			continue
+		}
+		queueMutex.Unlock()
+
+		replies, err := dispatch(device, call.Method)
+		if err != nil {
+			fmt.Println("Queued call to", device, "failed:", err)
+			db.AddQueued(call)
+			break
+		}
+		call.Status = "ok"
+		if replies {
+			call.Status = "pending"
+		}
+		call.Sent = &now
+		db.AddCall(call)
+	}
+
+	queueMutex.Lock()
+	queued[device] = len(db.GetQueued(device)) > 0
+	delete(flushing, device)
+	queueMutex.Unlock()
+}
+
+// flushAll delivers the queued calls of every reachable device, the calls sent while disconnected from
+// the broker are queued too
+func flushAll() {
+	queueMutex.Lock()
+	var devices []string
+	for device, pending := range queued {
+		if pending && reachable(device) {
+			devices = append(devices, device)
+		}
+	}
+	queueMutex.Unlock()
+	for _, device := range devices {
+		go flush(device)
+	}
+}
+
+// Cancel removes a call from the queue of a device
+func Cancel(device, id string) error {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	call := db.GetCall(device, id)
+	if call.ID == "" || call.Status != "queued" {
+		return errors.New("Call not queued")
+	}
+	call.Status = "cancelled"
+	db.AddCall(call)
+	return db.DeleteQueued(device, id)
+}
+
+// expireLoop drops the expired calls from the queues every minute, until Stop is called
+func expireLoop() {
+	defer close(stopped)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			expire(now)
+		}
+	}
+}
+
+// expire drops the calls whose time to live ended before now from the queues
+func expire(now time.Time) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	for _, call := range db.GetAllQueued() {
+		if call.Expires != nil && now.After(*call.Expires) {
+			call.Status = "expired"
+			db.AddCall(call)
+			db.DeleteQueued(call.Device, call.ID)
+		}
+	}
+}
+
+// Stop stops delivering and expiring the queued calls, and waits for the deliveries in progress.
+// The calls still queued are delivered on the next start
+func Stop() {
+	queueMutex.Lock()
+	stopping = true
+	queueMutex.Unlock()
+	close(stop)
+	<-stopped
+	flushes.Wait()
+}
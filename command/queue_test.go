@@ -0,0 +1,92 @@
+package command
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/storage"
+)
+
+func tempStorage(t *testing.T) (*storage.Badger, func()) {
+	dir, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	badger := storage.NewBadger(dir)
+	return badger, func() {
+		badger.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	var cleanup func()
+	db, cleanup = tempStorage(t)
+	defer cleanup()
+
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Hour)
+	for _, call := range []common.Call{
+		{ID: "1", Device: "garden", Method: common.Method{Name: "water"}, Expires: &past},
+		{ID: "2", Device: "garden", Method: common.Method{Name: "water"}, Expires: &future},
+		{ID: "3", Device: "garage", Method: common.Method{Name: "open"}, Expires: &past},
+	} {
+		if err := enqueue(call); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expire(now)
+
+	if calls := db.GetAllQueued(); len(calls) != 1 || calls[0].ID != "2" {
+		t.Errorf("queued %v", calls)
+	}
+	for _, test := range []struct{ device, id, status string }{
+		{"garden", "1", "expired"},
+		{"garden", "2", "queued"},
+		{"garage", "3", "expired"},
+	} {
+		if status := db.GetCall(test.device, test.id).Status; status != test.status {
+			t.Errorf("call %s of %s is %s, want %s", test.id, test.device, status, test.status)
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	var cleanup func()
+	db, cleanup = tempStorage(t)
+	defer cleanup()
+
+	expires := time.Now().Add(time.Hour)
+	if err := enqueue(common.Call{ID: "1", Device: "garden", Expires: &expires}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Cancel("garden", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if status := db.GetCall("garden", "1").Status; status != "cancelled" {
+		t.Errorf("status %s", status)
+	}
+	if len(db.GetQueued("garden")) != 0 {
+		t.Error("cancelled call still queued")
+	}
+	if err := Cancel("garden", "1"); err == nil {
+		t.Error("a call can only be cancelled once")
+	}
+}
+
+func TestNextID(t *testing.T) {
+	now := time.Now()
+	seen := make(map[string]bool)
+	for k := 0; k < 100; k++ {
+		id := nextID(now)
+		if seen[id] {
+			t.Fatalf("repeated ID %s", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,114 @@
+package command
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/conejoninja/home/common"
+)
+
+// Validate checks a call against the methods declared by the device, and converts its params to the
+// declared types. Declared params are required unless they have a default value
+func Validate(device common.Device, method common.Method) (common.Method, []string) {
+	var declared *common.Method
+	for k := range device.Methods {
+		if device.Methods[k].Name == method.Name {
+			declared = &device.Methods[k]
+			break
+		}
+	}
+	if declared == nil {
+		return method, []string{fmt.Sprintf("unknown method %s", method.Name)}
+	}
+
+	var problems []string
+	given := make(map[string]interface{}, len(method.Params))
+	for _, param := range method.Params {
+		given[param.ID] = param.Value
+	}
+	known := make(map[string]bool, len(declared.Params))
+	params := make([]common.Value, 0, len(declared.Params))
+	for _, param := range declared.Params {
+		known[param.ID] = true
+		value, ok := given[param.ID]
+		if !ok {
+			if param.Value == nil {
+				problems = append(problems, fmt.Sprintf("missing parameter %s", param.ID))
+				continue
+			}
+			value = param.Value
+		}
+		converted, err := convertParam(param, value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("parameter %s: %s", param.ID, err))
+			continue
+		}
+		params = append(params, common.Value{ID: param.ID, Value: converted})
+	}
+	for _, param := range method.Params {
+		if !known[param.ID] {
+			problems = append(problems, fmt.Sprintf("unknown parameter %s", param.ID))
+		}
+	}
+
+	method.Params = params
+	return method, problems
+}
+
+// convertParam converts a param to its declared type and checks its limits
+func convertParam(param common.Value, value interface{}) (interface{}, error) {
+	switch param.Type {
+	case "number", "float", "int", "integer":
+		var val float64
+		var err error
+		if str, ok := value.(string); ok {
+			val, err = strconv.ParseFloat(str, 64)
+		} else if _, ok := value.(bool); ok || value == nil {
+			err = fmt.Errorf("not a number: %v", value)
+		} else {
+			val, err = common.GetFloat(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("not a number: %v", value)
+		}
+		if (param.Type == "int" || param.Type == "integer") && val != math.Trunc(val) {
+			return nil, fmt.Errorf("not an integer: %v", value)
+		}
+		if min, err := strconv.ParseFloat(param.Min, 64); err == nil && val < min {
+			return nil, fmt.Errorf("%v below minimum %s", val, param.Min)
+		}
+		if max, err := strconv.ParseFloat(param.Max, 64); err == nil && val > max {
+			return nil, fmt.Errorf("%v above maximum %s", val, param.Max)
+		}
+		if param.Type == "int" || param.Type == "integer" {
+			return int64(val), nil
+		}
+		return val, nil
+	case "bool", "boolean":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("not a boolean: %v", value)
+			}
+			return b, nil
+		}
+		return nil, fmt.Errorf("not a boolean: %v", value)
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("not a string: %v", value)
+		}
+		if min, err := strconv.Atoi(param.Min); err == nil && len(str) < min {
+			return nil, fmt.Errorf("shorter than %s", param.Min)
+		}
+		if max, err := strconv.Atoi(param.Max); err == nil && len(str) > max {
+			return nil, fmt.Errorf("longer than %s", param.Max)
+		}
+		return str, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,67 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DevicePlaceholder is replaced by the ID of the device in the topic templates
+const DevicePlaceholder = "{device}"
+
+// DeviceTopic returns the topic of a device given a template like "home/{device}/values"
+func DeviceTopic(template, device string) string {
+	return strings.Replace(template, DevicePlaceholder, device, -1)
+}
+
+// CheckTemplate checks the placeholder of a template fills a whole topic level, otherwise its wildcard
+// wouldn't be a valid subscription filter
+func CheckTemplate(template string) error {
+	if strings.Count(template, DevicePlaceholder) != 1 {
+		return fmt.Errorf("%s needs %s once", template, DevicePlaceholder)
+	}
+	for _, level := range strings.Split(template, "/") {
+		if strings.ContainsAny(level, "+#") {
+			return fmt.Errorf("%s can't have wildcards", template)
+		}
+		if strings.Contains(level, DevicePlaceholder) && level != DevicePlaceholder {
+			return fmt.Errorf("%s has to be a whole level of %s", DevicePlaceholder, template)
+		}
+	}
+	return nil
+}
+
+// WildcardTopic returns the filter matching the topics of every device given a template
+func WildcardTopic(template string) string {
+	return strings.Replace(template, DevicePlaceholder, "+", -1)
+}
+
+// TopicDevice returns the ID of the device of a topic given a template, ok is false if the topic doesn't match it
+func TopicDevice(template, topic string) (device string, ok bool) {
+	parts := strings.SplitN(template, DevicePlaceholder, 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	if len(topic) <= len(parts[0])+len(parts[1]) || !strings.HasPrefix(topic, parts[0]) || !strings.HasSuffix(topic, parts[1]) {
+		return "", false
+	}
+	device = topic[len(parts[0]) : len(topic)-len(parts[1])]
+	if strings.Contains(device, "/") {
+		return "", false
+	}
+	return device, true
+}
+
+// TopicMatches checks if a topic matches a subscription filter with + and # wildcards
+func TopicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for k, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if k >= len(topicLevels) || (level != "+" && level != topicLevels[k]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
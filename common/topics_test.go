@@ -0,0 +1,67 @@
+package common
+
+import "testing"
+
+func TestDeviceTopic(t *testing.T) {
+	if topic := DeviceTopic("home/{device}/values", "garden"); topic != "home/garden/values" {
+		t.Errorf("got %s", topic)
+	}
+	if topic := WildcardTopic("home/{device}/values"); topic != "home/+/values" {
+		t.Errorf("got %s", topic)
+	}
+}
+
+func TestTopicDevice(t *testing.T) {
+	tests := []struct {
+		template, topic, device string
+		ok                      bool
+	}{
+		{"home/{device}/values", "home/garden/values", "garden", true},
+		{"{device}", "garden", "garden", true},
+		{"{device}/availability", "garden/availability", "garden", true},
+		{"home/{device}/values", "home/garden/events", "", false},
+		{"home/{device}/values", "home//values", "", false},
+		{"home/{device}/values", "home/a/b/values", "", false},
+		{"home/values", "home/values", "", false},
+	}
+	for _, test := range tests {
+		device, ok := TopicDevice(test.template, test.topic)
+		if device != test.device || ok != test.ok {
+			t.Errorf("TopicDevice(%q, %q) = %q, %v; want %q, %v", test.template, test.topic, device, ok, test.device, test.ok)
+		}
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"home/+/values", "home/garden/values", true},
+		{"home/#", "home/garden/values", true},
+		{"+", "garden", true},
+		{"+", "garden/values", false},
+		{"home/+/values", "home/garden/events", false},
+		{"home/+/values", "home/garden", false},
+	}
+	for _, test := range tests {
+		if match := TopicMatches(test.filter, test.topic); match != test.match {
+			t.Errorf("TopicMatches(%q, %q) = %v", test.filter, test.topic, match)
+		}
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	valid := []string{"{device}", "home/{device}/values", "{device}/availability"}
+	for _, template := range valid {
+		if err := CheckTemplate(template); err != nil {
+			t.Errorf("%s: %s", template, err)
+		}
+	}
+	invalid := []string{"home/dev-{device}/x", "{device}-call", "home/values", "{device}/{device}", "home/+/{device}", "{device}/#"}
+	for _, template := range invalid {
+		if err := CheckTemplate(template); err == nil {
+			t.Errorf("%s should be rejected", template)
+		}
+	}
+}
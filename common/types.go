@@ -8,29 +8,57 @@ import (
 
 // Device type: Description of the device, which sensor data it sends and which methods it has
 type Device struct {
-	ID      string   `json:"id"`
-	Name    string   `json:"name,omitempty"`
-	Version string   `json:"version,omitempty"`
-	Out     []Value  `json:"out,omitempty"`
-	Methods []Method `json:"methods,omitempty"`
+	ID                string     `json:"id"`
+	Name              string     `json:"name,omitempty"`
+	Version           string     `json:"version,omitempty"`
+	Out               []Value    `json:"out,omitempty"`
+	Methods           []Method   `json:"methods,omitempty"`
+	Format            string     `json:"format,omitempty"`
+	Availability      string     `json:"availability,omitempty"`
+	AvailabilitySince *time.Time `json:"availability_since,omitempty"`
 }
 
 // Value type
 type Value struct {
-	ID    string      `json:"id"`
-	Type  string      `json:"type,omitempty"`
-	Name  string      `json:"name,omitempty"`
-	Unit  string      `json:"unit,omitempty"`
-	Min   string      `json:"min,omitempty"`
-	Max   string      `json:"max,omitempty"`
-	Time  *time.Time  `json:"time,omitempty"`
-	Value interface{} `json:"value,omitempty"`
+	ID      string      `json:"id"`
+	Type    string      `json:"type,omitempty"`
+	Name    string      `json:"name,omitempty"`
+	Unit    string      `json:"unit,omitempty"`
+	Min     string      `json:"min,omitempty"`
+	Max     string      `json:"max,omitempty"`
+	Time    *time.Time  `json:"time,omitempty"`
+	Value   interface{} `json:"value,omitempty"`
+	Invalid string      `json:"invalid,omitempty"`
 }
 
-// Method type
+// Method type. ID correlates the call with the reply of the device, sent to the ReplyTo topic
 type Method struct {
-	Name   string  `json:"name"`
-	Params []Value `json:"params,omitempty"`
+	Name    string  `json:"name"`
+	Params  []Value `json:"params,omitempty"`
+	ID      string  `json:"id,omitempty"`
+	ReplyTo string  `json:"reply_to,omitempty"`
+}
+
+// Reply type: answer of a device to a method call, ID is the one of the method
+type Reply struct {
+	ID     string      `json:"id"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Call type: a method sent to a device and its outcome. Status is queued (waiting for the device to be
+// online until Expires), pending, ok, error (replied by the device), timeout (no reply yet), failed (not
+// sent), expired or cancelled
+type Call struct {
+	ID      string      `json:"id"`
+	Device  string      `json:"device"`
+	Method  Method      `json:"method"`
+	Status  string      `json:"status"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Sent    *time.Time  `json:"sent,omitempty"`
+	Replied *time.Time  `json:"replied,omitempty"`
+	Expires *time.Time  `json:"expires,omitempty"`
 }
 
 // Param Type
@@ -50,26 +78,197 @@ type Event struct {
 
 // Meta type: Holds some meta data (maximum, minimum and average) of the sensor value
 type Meta struct {
-	Max float64 `json:"max,omitempty"`
-	Min float64 `json:"min,omitempty"`
-	Avg float64 `json:"avg,omitempty"`
-	N   int     `json:"n,omitempty"`
+	Max  float64 `json:"max,omitempty"`
+	Min  float64 `json:"min,omitempty"`
+	Avg  float64 `json:"avg,omitempty"`
+	N    int     `json:"n,omitempty"`
+	Unit string  `json:"unit,omitempty"`
+}
+
+// Quarantined type: a value rejected by the validation against its device descriptor
+type Quarantined struct {
+	Device string     `json:"device"`
+	Value  Value      `json:"value"`
+	Reason string     `json:"reason"`
+	Time   *time.Time `json:"time,omitempty"`
+}
+
+// Deadband type: readings of a sensor within Absolute (or Percent of the last stored one) of the last stored
+// reading are not stored, unless Interval has passed since then
+type Deadband struct {
+	Absolute float64
+	Percent  float64
+	Interval time.Duration
+}
+
+// VirtualSensor type: sensor computed from an expression over other sensors ("<device>-<value id>"),
+// like "[plug1-power] + [plug2-power]"
+type VirtualSensor struct {
+	ID         string
+	Name       string
+	Unit       string
+	Expression string
+}
+
+// Rule type: automation rule, calls a device method when a sensor value (or an event) matches a condition.
+// Sensor is "<device>-<value id>", From and To are "15:04" times and For a duration like "10m"
+type Rule struct {
+	Name     string                 `json:"name" yaml:"name"`
+	Enabled  bool                   `json:"enabled" yaml:"enabled"`
+	Sensor   string                 `json:"sensor,omitempty" yaml:"sensor"`
+	Event    string                 `json:"event,omitempty" yaml:"event"`
+	Operator string                 `json:"operator,omitempty" yaml:"operator"`
+	Value    string                 `json:"value,omitempty" yaml:"value"`
+	For      string                 `json:"for,omitempty" yaml:"for"`
+	From     string                 `json:"from,omitempty" yaml:"from"`
+	To       string                 `json:"to,omitempty" yaml:"to"`
+	Device   string                 `json:"device" yaml:"device"`
+	Method   string                 `json:"method" yaml:"method"`
+	Params   map[string]interface{} `json:"params,omitempty" yaml:"params"`
+}
+
+// Schedule type: calls a device method periodically. Cron is a standard 5 fields expression, or Sun is
+// "sunrise" or "sunset" with an optional Offset like "-30m"
+type Schedule struct {
+	ID      string     `json:"id"`
+	Enabled bool       `json:"enabled"`
+	Cron    string     `json:"cron,omitempty"`
+	Sun     string     `json:"sun,omitempty"`
+	Offset  string     `json:"offset,omitempty"`
+	Device  string     `json:"device"`
+	Method  Method     `json:"method"`
+	LastRun *time.Time `json:"last_run,omitempty"`
+}
+
+// Scene type: named list of device method calls, run in order
+type Scene struct {
+	Name  string      `json:"name"`
+	Steps []SceneStep `json:"steps"`
+}
+
+// SceneStep type: a method call of a scene, Delay (like "2s") is waited before calling it
+type SceneStep struct {
+	Device string `json:"device"`
+	Method Method `json:"method"`
+	Delay  string `json:"delay,omitempty"`
+}
+
+// CallResult type: outcome of a method call to a device, pending if it's still waiting for its delay
+type CallResult struct {
+	Device  string `json:"device"`
+	Method  string `json:"method"`
+	Error   string `json:"error,omitempty"`
+	Pending bool   `json:"pending,omitempty"`
+}
+
+// DeadLetter type: a MQTT message that couldn't be parsed, kept to inspect or replay it. The payload
+// is kept as it was received, base64 encoded in JSON, so binary payloads could be replayed too
+type DeadLetter struct {
+	ID      string     `json:"id"`
+	Topic   string     `json:"topic"`
+	Payload []byte     `json:"payload"`
+	Error   string     `json:"error"`
+	Time    *time.Time `json:"time"`
+}
+
+// Shadow type: the desired state of a device set through the API, and the state reported by its values.
+// Delta has the desired values the device didn't report yet, LastCall is the last call sending it.
+// Attempts counts the calls sending the delta, Error is set once they are given up
+type Shadow struct {
+	Device   string                 `json:"device"`
+	Desired  map[string]interface{} `json:"desired"`
+	Reported map[string]interface{} `json:"reported"`
+	Delta    map[string]interface{} `json:"delta,omitempty"`
+	Version  int                    `json:"version"`
+	Updated  *time.Time             `json:"updated,omitempty"`
+	LastCall string                 `json:"last_call,omitempty"`
+	Attempts int                    `json:"attempts,omitempty"`
+	Error    string                 `json:"error,omitempty"`
 }
 
-// MQTTConfig type for configuration of the MQTT server
+// Status type: state of the service and of everything it depends on
+type Status struct {
+	Status    string          `json:"status"`
+	Problems  []string        `json:"problems,omitempty"`
+	Started   *time.Time      `json:"started"`
+	Uptime    string          `json:"uptime"`
+	MQTT      MQTTStatus      `json:"mqtt"`
+	Storage   StorageStatus   `json:"storage"`
+	Ingestion IngestionStatus `json:"ingestion"`
+	Telegram  TelegramStatus  `json:"telegram"`
+}
+
+// StorageStatus type
+type StorageStatus struct {
+	Open bool  `json:"open"`
+	Size int64 `json:"size"`
+}
+
+// IngestionStatus type: Rate is the messages received per second over the last minute
+type IngestionStatus struct {
+	Messages    uint64     `json:"messages"`
+	Rate        float64    `json:"rate"`
+	LastMessage *time.Time `json:"last_message,omitempty"`
+}
+
+// TelegramStatus type
+type TelegramStatus struct {
+	Enabled   bool `json:"enabled"`
+	Connected bool `json:"connected"`
+}
+
+// MQTTConfig type for configuration of the MQTT server. The topics of the devices are templates
+// with the {device} placeholder
 type MQTTConfig struct {
-	Protocol, Server, Port, User, Password, ClientID string
+	Protocol, Server, Port, User, Password, ClientID    string
+	DiscoveryTopic, EventsTopic, ValuesTopic, CallTopic string
+	AvailabilityTopic, ReplyTopic                       string
+	PersistentSession                                   bool
+}
+
+// BrokerConfig type for the embedded MQTT broker, the service connects to it instead of to MQTT.Server
+type BrokerConfig struct {
+	Port, WSPort   string
+	User, Password string
+	Enabled        bool
+}
+
+// MQTTStatus type: state of the connection to the MQTT broker
+type MQTTStatus struct {
+	Connected     bool       `json:"connected"`
+	Since         *time.Time `json:"since,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	Reconnections int        `json:"reconnections"`
+	Subscriptions int        `json:"subscriptions"`
 }
 
 // HomeConfig type for general configuration
 type HomeConfig struct {
-	DBPath   string
-	MQTT     MQTTConfig
-	WS       WebsocketConfig
-	API      APIConfig
-	Tg       TelegramConfig
-	TimeZone string
-	Location *time.Location
+	DBPath          string
+	MQTT            MQTTConfig
+	Broker          BrokerConfig
+	WS              WebsocketConfig
+	API             APIConfig
+	Tg              TelegramConfig
+	HA              HomeAssistantConfig
+	Homie           HomieConfig
+	Alerts          AlertConfig
+	Anomaly         AnomalyConfig
+	Validation      string
+	CallTTL         time.Duration
+	SeenTimeout     time.Duration
+	ShadowRetry     time.Duration
+	ShadowAttempts  int
+	DeadLetters     int
+	ShutdownTimeout time.Duration
+	Decoders        map[string]string
+	Deadband        map[string]Deadband
+	Virtual         []VirtualSensor
+	RulesFile       string
+	Latitude        float64
+	Longitude       float64
+	TimeZone        string
+	Location        *time.Location
 }
 
 // WebsocketConfig type
@@ -78,6 +277,18 @@ type WebsocketConfig struct {
 	Enabled bool
 }
 
+// HomeAssistantConfig type: publishes the devices with the MQTT discovery of Home Assistant
+type HomeAssistantConfig struct {
+	Prefix  string
+	Enabled bool
+}
+
+// HomieConfig type: adapter for the devices following the Homie convention
+type HomieConfig struct {
+	Prefix  string
+	Enabled bool
+}
+
 // APIConfig type
 type APIConfig struct {
 	Port    string
@@ -91,6 +302,30 @@ type TelegramConfig struct {
 	Enabled bool
 }
 
+// AlertConfig type: default hysteresis and debounce of the alerts, and user thresholds per sensor
+type AlertConfig struct {
+	Hysteresis float64
+	Debounce   time.Duration
+	Thresholds map[string]Threshold
+}
+
+// AnomalyConfig type: readings deviating more than Threshold from the baseline of the same hour of the day
+// over the last Days are reported. Method is "zscore" or "mad"
+type AnomalyConfig struct {
+	Enabled   bool
+	Method    string
+	Threshold float64
+	Days      int
+}
+
+// Threshold type: overrides the Min and Max of a sensor ("<device>-<value id>") declared by its device
+type Threshold struct {
+	Min        string
+	Max        string
+	Hysteresis float64
+	Debounce   time.Duration
+}
+
 var floatType = reflect.TypeOf(float64(0))
 
 // GetFloat converts an interface to a float64
@@ -0,0 +1,175 @@
+package connection
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/conejoninja/home/common"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	minBackoff = 1 * time.Second
+	maxBackoff = 1 * time.Minute
+)
+
+type subscription struct {
+	filters map[string]byte
+	handler mqtt.MessageHandler
+}
+
+var c mqtt.Client
+var cfg common.HomeConfig
+
+var subscriptions []subscription
+var connectHandlers []func()
+var state common.MQTTStatus
+var mutex sync.Mutex
+
+// Start sets the MQTT client whose connection is managed
+func Start(homecfg common.HomeConfig, mqttclient mqtt.Client) {
+	cfg = homecfg
+	c = mqttclient
+}
+
+// QoS returns the QoS of the subscriptions, messages are only kept by the broker
+// while disconnected if the session is persistent and the QoS is 1
+func QoS() byte {
+	if cfg.MQTT.PersistentSession {
+		return 1
+	}
+	return 0
+}
+
+// OnConnect is called every time the client (re)connects to the broker, it restores every subscription
+func OnConnect(client mqtt.Client) {
+	mutex.Lock()
+	now := time.Now()
+	if !state.Connected && state.Since != nil {
+		state.Reconnections++
+	}
+	state.Connected = true
+	state.Since = &now
+	subs := make([]subscription, len(subscriptions))
+	copy(subs, subscriptions)
+	handlers := make([]func(), len(connectHandlers))
+	copy(handlers, connectHandlers)
+	mutex.Unlock()
+
+	fmt.Println(now, "MQTT connected to", cfg.MQTT.Server)
+	for _, sub := range subs {
+		go subscribe(sub)
+	}
+	for _, handler := range handlers {
+		go handler()
+	}
+}
+
+// AddConnectHandler registers a function called every time the client (re)connects to the broker
+func AddConnectHandler(handler func()) {
+	mutex.Lock()
+	connectHandlers = append(connectHandlers, handler)
+	mutex.Unlock()
+}
+
+// DefaultHandler takes the messages no subscription matches, so they are acknowledged anyway
+var DefaultHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	fmt.Println(time.Now(), "Unexpected message on", msg.Topic())
+}
+
+// OnConnectionLost is called when the connection to the broker drops, the client reconnects by itself
+func OnConnectionLost(client mqtt.Client, err error) {
+	mutex.Lock()
+	now := time.Now()
+	state.Connected = false
+	state.Since = &now
+	state.LastError = err.Error()
+	mutex.Unlock()
+
+	fmt.Println(now, "MQTT connection lost:", err)
+}
+
+// Subscribe registers a subscription which is established now and again on every reconnection. Its
+// handler takes the messages of the filters right away, even the ones received before subscribing
+func Subscribe(filters map[string]byte, handler mqtt.MessageHandler) {
+	sub := subscription{filters: filters, handler: handler}
+	for filter := range filters {
+		c.AddRoute(filter, handler)
+	}
+	mutex.Lock()
+	subscriptions = append(subscriptions, sub)
+	state.Subscriptions += len(filters)
+	mutex.Unlock()
+
+	if c.IsConnected() {
+		go subscribe(sub)
+	}
+}
+
+// subscribe retries with exponential backoff until it succeeds or the connection is lost
+func subscribe(sub subscription) {
+	backoff := minBackoff
+	for c.IsConnected() {
+		token := c.SubscribeMultiple(sub.filters, sub.handler)
+		if token.WaitTimeout(10*time.Second) && token.Error() == nil {
+			for filter := range sub.filters {
+				fmt.Println(time.Now(), "Subscribed to", filter)
+			}
+			return
+		}
+		err := token.Error()
+		if err == nil {
+			err = fmt.Errorf("subscription timed out")
+		}
+		mutex.Lock()
+		state.LastError = err.Error()
+		mutex.Unlock()
+		fmt.Println(time.Now(), "Subscription failed, retrying in", backoff, ":", err)
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Stop unsubscribes and disconnects from the broker, waiting up to timeout for the work in progress.
+// Persistent sessions keep their subscriptions so the broker holds the messages until we're back
+func Stop(timeout time.Duration) {
+	if !c.IsConnected() {
+		return
+	}
+	if !cfg.MQTT.PersistentSession {
+		mutex.Lock()
+		var filters []string
+		for _, sub := range subscriptions {
+			for filter := range sub.filters {
+				filters = append(filters, filter)
+			}
+		}
+		mutex.Unlock()
+		if len(filters) > 0 {
+			token := c.Unsubscribe(filters...)
+			if !token.WaitTimeout(timeout) || token.Error() != nil {
+				fmt.Println(time.Now(), "Unsubscribe failed:", token.Error())
+			}
+		}
+	}
+	c.Disconnect(uint(timeout / time.Millisecond))
+
+	mutex.Lock()
+	now := time.Now()
+	state.Connected = false
+	state.Since = &now
+	mutex.Unlock()
+	fmt.Println(now, "MQTT disconnected")
+}
+
+// Status returns the state of the connection to the broker
+func Status() common.MQTTStatus {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return state
+}
@@ -0,0 +1,103 @@
+package decoder
+
+import (
+	"errors"
+	"math"
+
+	"github.com/conejoninja/home/common"
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func decodeCBOR(device common.Device, payload []byte) ([]common.Value, error) {
+	var generic interface{}
+	if err := codec.NewDecoderBytes(payload, new(codec.CborHandle)).Decode(&generic); err != nil {
+		return nil, err
+	}
+	return fromGeneric(device, generic)
+}
+
+func decodeMsgpack(device common.Device, payload []byte) ([]common.Value, error) {
+	var generic interface{}
+	handle := new(codec.MsgpackHandle)
+	handle.RawToString = true
+	if err := codec.NewDecoderBytes(payload, handle).Decode(&generic); err != nil {
+		return nil, err
+	}
+	return fromGeneric(device, generic)
+}
+
+// decodeProtobuf decodes the following messages without generated code:
+//
+//	message Values { repeated Value values = 1; }
+//	message Value { string id = 1; double value = 2; int64 time = 3; string unit = 4; }
+func decodeProtobuf(device common.Device, payload []byte) ([]common.Value, error) {
+	var values []common.Value
+	for len(payload) > 0 {
+		num, typ, n := protowire.ConsumeTag(payload)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		payload = payload[n:]
+		if num == 1 && typ == protowire.BytesType {
+			msg, n := protowire.ConsumeBytes(payload)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			value, err := decodeProtobufValue(msg)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+			payload = payload[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, payload)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		payload = payload[n:]
+	}
+	return values, nil
+}
+
+func decodeProtobufValue(msg []byte) (common.Value, error) {
+	var value common.Value
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return value, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			var b []byte
+			b, n = protowire.ConsumeBytes(msg)
+			value.ID = string(b)
+		case num == 2 && typ == protowire.Fixed64Type:
+			var v uint64
+			v, n = protowire.ConsumeFixed64(msg)
+			value.Value = math.Float64frombits(v)
+		case num == 3 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(msg)
+			if t, ok := parseTime(int64(v)); ok {
+				value.Time = &t
+			}
+		case num == 4 && typ == protowire.BytesType:
+			var b []byte
+			b, n = protowire.ConsumeBytes(msg)
+			value.Unit = string(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+		}
+		if n < 0 {
+			return value, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	if value.ID == "" {
+		return value, errors.New("value without id")
+	}
+	return value, nil
+}
@@ -0,0 +1,177 @@
+package decoder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/conejoninja/home/common"
+)
+
+// Decoder turns the payload sent by a device into values
+type Decoder func(device common.Device, payload []byte) ([]common.Value, error)
+
+var decoders = make(map[string]Decoder)
+var mutex sync.RWMutex
+
+func init() {
+	Register("json", decodeJSON)
+	Register("cbor", decodeCBOR)
+	Register("msgpack", decodeMsgpack)
+	Register("protobuf", decodeProtobuf)
+	Register("number", decodeNumber)
+}
+
+// Register adds a decoder for a format, replacing the previous one
+func Register(format string, decoder Decoder) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	decoders[format] = decoder
+}
+
+// Decode the payload of a device with the decoder of the given format, JSON if empty
+func Decode(format string, device common.Device, payload []byte) ([]common.Value, error) {
+	if format == "" {
+		format = "json"
+	}
+	mutex.RLock()
+	decoder, ok := decoders[format]
+	mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown format %s", format)
+	}
+	return decoder(device, payload)
+}
+
+// decodeJSON accepts an array of values, a single value or an object of sensor ID: value
+func decodeJSON(device common.Device, payload []byte) ([]common.Value, error) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var values []common.Value
+		err := json.Unmarshal(trimmed, &values)
+		return values, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(trimmed, &generic); err != nil {
+		return nil, err
+	}
+	return fromGeneric(device, generic)
+}
+
+// decodeNumber accepts a plain number, stored as the only value of the device
+func decodeNumber(device common.Device, payload []byte) ([]common.Value, error) {
+	val, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+	if err != nil {
+		return nil, err
+	}
+	return []common.Value{{ID: defaultID(device), Value: val}}, nil
+}
+
+// defaultID is the ID of the value of payloads that don't carry one
+func defaultID(device common.Device) string {
+	if len(device.Out) == 1 {
+		return device.Out[0].ID
+	}
+	return "value"
+}
+
+// fromGeneric builds the values from a decoded payload: an array of values, a single value
+// (an object with an id) or an object of sensor ID: value
+func fromGeneric(device common.Device, generic interface{}) ([]common.Value, error) {
+	switch v := generic.(type) {
+	case []interface{}:
+		values := make([]common.Value, 0, len(v))
+		for _, item := range v {
+			m, ok := toMap(item)
+			if !ok {
+				return nil, errors.New("array items should be objects")
+			}
+			value, err := fromMap(m)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	case nil:
+		return nil, errors.New("empty payload")
+	default:
+		m, ok := toMap(v)
+		if !ok {
+			return []common.Value{{ID: defaultID(device), Value: v}}, nil
+		}
+		if _, ok := m["id"]; ok {
+			value, err := fromMap(m)
+			return []common.Value{value}, err
+		}
+		values := make([]common.Value, 0, len(m))
+		for id, val := range m {
+			values = append(values, common.Value{ID: id, Value: val})
+		}
+		return values, nil
+	}
+}
+
+// toMap converts the maps of the different decoders to map[string]interface{}
+func toMap(item interface{}) (map[string]interface{}, bool) {
+	switch m := item.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			converted[fmt.Sprint(k)] = v
+		}
+		return converted, true
+	}
+	return nil, false
+}
+
+func fromMap(m map[string]interface{}) (common.Value, error) {
+	var value common.Value
+	value.ID = str(m["id"])
+	if value.ID == "" {
+		return value, errors.New("value without id")
+	}
+	value.Type = str(m["type"])
+	value.Name = str(m["name"])
+	value.Unit = str(m["unit"])
+	value.Value = m["value"]
+	if t, ok := parseTime(m["time"]); ok {
+		value.Time = &t
+	}
+	return value, nil
+}
+
+func str(v interface{}) string {
+	switch s := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(s)
+	}
+	return fmt.Sprint(v)
+}
+
+// parseTime accepts RFC 3339 dates and unix timestamps
+func parseTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case string:
+		parsed, err := time.Parse(time.RFC3339, t)
+		return parsed, err == nil
+	case time.Time:
+		return t, true
+	case nil:
+		return time.Time{}, false
+	}
+	ts, err := common.GetFloat(v)
+	if err != nil || ts <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(ts), 0), true
+}
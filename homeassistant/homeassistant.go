@@ -0,0 +1,311 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/conejoninja/home/command"
+	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/connection"
+	"github.com/conejoninja/home/storage"
+	"github.com/conejoninja/home/units"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var db storage.Storage
+var cfg common.HomeConfig
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name,omitempty"`
+	SwVersion    string   `json:"sw_version,omitempty"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+}
+
+// entity is the discovery config of a Home Assistant entity
+type entity struct {
+	Name                string   `json:"name"`
+	UniqueID            string   `json:"unique_id"`
+	StateTopic          string   `json:"state_topic,omitempty"`
+	CommandTopic        string   `json:"command_topic,omitempty"`
+	UnitOfMeasurement   string   `json:"unit_of_measurement,omitempty"`
+	DeviceClass         string   `json:"device_class,omitempty"`
+	StateClass          string   `json:"state_class,omitempty"`
+	PayloadPress        string   `json:"payload_press,omitempty"`
+	PayloadOn           string   `json:"payload_on,omitempty"`
+	PayloadOff          string   `json:"payload_off,omitempty"`
+	Optimistic          bool     `json:"optimistic,omitempty"`
+	AvailabilityTopic   string   `json:"availability_topic,omitempty"`
+	PayloadAvailable    string   `json:"payload_available,omitempty"`
+	PayloadNotAvailable string   `json:"payload_not_available,omitempty"`
+	Device              haDevice `json:"device"`
+}
+
+// Home Assistant units and device classes of the units we know
+var haUnits = map[string][2]string{
+	"degC": {"°C", "temperature"},
+	"degF": {"°F", "temperature"},
+	"K":    {"K", "temperature"},
+	"Pa":   {"Pa", "pressure"},
+	"hPa":  {"hPa", "pressure"},
+	"inHg": {"inHg", "pressure"},
+	"W":    {"W", "power"},
+	"kW":   {"kW", "power"},
+	"Wh":   {"Wh", "energy"},
+	"kWh":  {"kWh", "energy"},
+	"%":    {"%", ""},
+	"lux":  {"lx", "illuminance"},
+}
+
+// the retained messages are published in order by a single sender, so an older state never replaces
+// a newer one. Only the last payload of a topic waits to be published
+var outbox = make(map[string]string)
+var outboxOrder []string
+var outboxMutex sync.Mutex
+var wake = make(chan struct{}, 1)
+
+// devices whose discovery config has the availability topic
+var announced = make(map[string]bool)
+var announcedMutex sync.Mutex
+
+var invalidChars = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+func objectID(s string) string {
+	return invalidChars.ReplaceAllString(s, "_")
+}
+
+// Start publishes the discovery configs of every stored device and listens to the commands of Home Assistant
+func Start(homecfg common.HomeConfig, dbcon storage.Storage) {
+	cfg = homecfg
+	db = dbcon
+	if !cfg.HA.Enabled {
+		return
+	}
+
+	go sender()
+	connection.Subscribe(map[string]byte{cfg.HA.Prefix + "/+/+/+/set": connection.QoS()}, commandHandler)
+	// the discovery is published once connected, and again on every reconnection
+	connection.AddConnectHandler(func() {
+		for _, device := range db.GetDevices() {
+			PublishDevice(device)
+		}
+	})
+}
+
+// PublishDevice publishes the discovery config of every value and method of a device
+func PublishDevice(device common.Device) {
+	if !cfg.HA.Enabled || device.ID == "" {
+		return
+	}
+	node := objectID(device.ID)
+	dev := haDevice{
+		Identifiers:  []string{"home_" + node},
+		Name:         device.Name,
+		SwVersion:    device.Version,
+		Manufacturer: "home",
+	}
+	if dev.Name == "" {
+		dev.Name = device.ID
+	}
+	// Only devices whose availability is known get it, the rest would be unavailable forever
+	availability := ""
+	if device.Availability != "" {
+		availability = availabilityTopic(device.ID)
+		announcedMutex.Lock()
+		announced[device.ID] = true
+		announcedMutex.Unlock()
+		send(availability, device.Availability)
+	}
+
+	for _, out := range device.Out {
+		object := objectID(out.ID)
+		e := entity{
+			Name:                name(out.Name, out.ID),
+			UniqueID:            "home_" + node + "_" + object,
+			StateTopic:          stateTopic(device.ID, out.ID),
+			AvailabilityTopic:   availability,
+			PayloadAvailable:    "online",
+			PayloadNotAvailable: "offline",
+			Device:              dev,
+		}
+		if ha, ok := haUnits[units.Normalize(out.Unit)]; ok {
+			e.UnitOfMeasurement = ha[0]
+			e.DeviceClass = ha[1]
+			if e.DeviceClass == "" && strings.Contains(strings.ToLower(out.ID), "hum") {
+				e.DeviceClass = "humidity"
+			}
+		} else {
+			e.UnitOfMeasurement = out.Unit
+		}
+		if out.Type == "" || out.Type == "number" {
+			e.StateClass = "measurement"
+			if e.DeviceClass == "energy" {
+				e.StateClass = "total_increasing"
+			}
+		}
+		publish(cfg.HA.Prefix+"/sensor/"+node+"/"+object+"/config", e)
+	}
+
+	methods := make(map[string]bool)
+	for _, method := range device.Methods {
+		methods[method.Name] = true
+	}
+	for _, method := range device.Methods {
+		object := objectID(method.Name)
+		e := entity{
+			UniqueID:            "home_" + node + "_" + object,
+			AvailabilityTopic:   availability,
+			PayloadAvailable:    "online",
+			PayloadNotAvailable: "offline",
+			Device:              dev,
+		}
+		// A pair of on and off methods is a switch, every other method is a button
+		switch {
+		case method.Name == "on" && methods["off"]:
+			e.Name = dev.Name
+			e.UniqueID = "home_" + node + "_switch"
+			e.CommandTopic = cfg.HA.Prefix + "/switch/" + node + "/switch/set"
+			e.PayloadOn = "on"
+			e.PayloadOff = "off"
+			e.Optimistic = true
+			publish(cfg.HA.Prefix+"/switch/"+node+"/switch/config", e)
+		case method.Name == "off" && methods["on"]:
+		default:
+			e.Name = name("", method.Name)
+			e.CommandTopic = cfg.HA.Prefix + "/button/" + node + "/" + object + "/set"
+			e.PayloadPress = "PRESS"
+			publish(cfg.HA.Prefix+"/button/"+node+"/"+object+"/config", e)
+		}
+	}
+}
+
+// PublishAvailability publishes the availability of a device as online or offline, the discovery
+// config is published again the first time so its entities use it
+func PublishAvailability(device common.Device) {
+	if !cfg.HA.Enabled || device.Availability == "" {
+		return
+	}
+	announcedMutex.Lock()
+	done := announced[device.ID]
+	announcedMutex.Unlock()
+	if !done {
+		PublishDevice(device)
+		return
+	}
+	send(availabilityTopic(device.ID), device.Availability)
+}
+
+// availabilityTopic is the configured availability topic of a device under the prefix of Home Assistant,
+// owned by home and always online or offline whatever the device sends on its own
+func availabilityTopic(deviceID string) string {
+	return cfg.HA.Prefix + "/" + common.DeviceTopic(cfg.MQTT.AvailabilityTopic, objectID(deviceID))
+}
+
+// PublishValue republishes a value on its state topic, as a plain string Home Assistant could read
+func PublishValue(deviceID string, value common.Value) {
+	if !cfg.HA.Enabled || value.Value == nil {
+		return
+	}
+	send(stateTopic(deviceID, value.ID), fmt.Sprint(value.Value))
+}
+
+func stateTopic(deviceID, valueID string) string {
+	return cfg.HA.Prefix + "/sensor/" + objectID(deviceID) + "/" + objectID(valueID) + "/state"
+}
+
+func name(name, id string) string {
+	if name != "" {
+		return name
+	}
+	return strings.Replace(id, "-", " ", -1)
+}
+
+func publish(topic string, e entity) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	send(topic, string(payload))
+}
+
+// send queues a retained message to be published by the sender, replacing the one of its topic still
+// waiting
+func send(topic, payload string) {
+	outboxMutex.Lock()
+	if _, ok := outbox[topic]; !ok {
+		outboxOrder = append(outboxOrder, topic)
+	}
+	outbox[topic] = payload
+	outboxMutex.Unlock()
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// sender publishes the retained messages one after the other
+func sender() {
+	for range wake {
+		for {
+			outboxMutex.Lock()
+			if len(outboxOrder) == 0 {
+				outboxMutex.Unlock()
+				break
+			}
+			topic := outboxOrder[0]
+			outboxOrder = outboxOrder[1:]
+			payload := outbox[topic]
+			delete(outbox, topic)
+			outboxMutex.Unlock()
+
+			if err := command.Publish(topic, payload, true); err != nil {
+				fmt.Println("Home Assistant publish failed:", topic, err)
+			}
+		}
+	}
+}
+
+// commandHandler calls the method of a device when a Home Assistant button is pressed or a switch toggled
+var commandHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	// <prefix>/<component>/<node>/<object>/set
+	parts := strings.Split(strings.TrimPrefix(msg.Topic(), cfg.HA.Prefix+"/"), "/")
+	if len(parts) != 4 {
+		return
+	}
+	device := findDevice(parts[1])
+	if device == "" {
+		return
+	}
+	method := parts[2]
+	switch parts[0] {
+	case "switch":
+		method = strings.ToLower(string(msg.Payload()))
+	case "button":
+		for _, m := range db.GetDevice([]byte(device)).Methods {
+			if objectID(m.Name) == parts[2] {
+				method = m.Name
+			}
+		}
+	default:
+		return
+	}
+	go func() {
+		if err := command.Call(device, common.Method{Name: method}); err != nil {
+			fmt.Println("Home Assistant call failed:", err)
+		}
+	}()
+}
+
+// findDevice returns the ID of the device of a node of Home Assistant
+func findDevice(node string) string {
+	for _, device := range db.GetDevices() {
+		if objectID(device.ID) == node {
+			return device.ID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,127 @@
+package logger
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/conejoninja/home/common"
+)
+
+// minimum number of days with data needed before reporting anything
+const minBaselineDays = 5
+
+// baseline of a sensor for an hour of the day, computed from the hourly meta of the previous days
+type baseline struct {
+	day    time.Time
+	center float64
+	spread float64
+	ok     bool
+}
+
+var baselines = make(map[string]*baseline)
+var anomalous = make(map[string]bool)
+var anomalyMutex sync.Mutex
+
+// getBaseline returns the baseline of the sensor at the hour of the day of datetime, it's computed
+// once per day and hour
+func getBaseline(sensor string, datetime time.Time) *baseline {
+	datetime = datetime.In(cfg.Location)
+	day := time.Date(datetime.Year(), datetime.Month(), datetime.Day(), 0, 0, 0, 0, cfg.Location)
+	key := sensor + "-" + strconv.Itoa(datetime.Hour())
+	if b, ok := baselines[key]; ok && b.day.Equal(day) {
+		return b
+	}
+
+	b := &baseline{day: day}
+	baselines[key] = b
+
+	averages := make([]float64, 0, cfg.Anomaly.Days)
+	for i := 1; i <= cfg.Anomaly.Days; i++ {
+		start := time.Date(day.Year(), day.Month(), day.Day()-i, datetime.Hour(), 0, 0, 0, cfg.Location)
+		meta := db.GetMeta([]byte(sensor + "-hour-" + strconv.Itoa(int(start.Unix()))))
+		if meta.N > 0 {
+			averages = append(averages, meta.Avg)
+		}
+	}
+	if len(averages) < minBaselineDays {
+		return b
+	}
+
+	if cfg.Anomaly.Method == "mad" {
+		b.center = median(averages)
+		deviations := make([]float64, len(averages))
+		for k, avg := range averages {
+			deviations[k] = math.Abs(avg - b.center)
+		}
+		// scaled so it's comparable to the standard deviation
+		b.spread = median(deviations) / 0.6745
+	} else {
+		for _, avg := range averages {
+			b.center += avg
+		}
+		b.center /= float64(len(averages))
+		for _, avg := range averages {
+			b.spread += (avg - b.center) * (avg - b.center)
+		}
+		b.spread = math.Sqrt(b.spread / float64(len(averages)-1))
+	}
+	b.ok = b.spread > 1e-9
+	return b
+}
+
+func median(values []float64) float64 {
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	l := len(sorted)
+	if l%2 == 0 {
+		return (sorted[l/2-1] + sorted[l/2]) / 2
+	}
+	return sorted[l/2]
+}
+
+// checkAnomaly compares a reading against the baseline of the sensor and generates an event
+// when it deviates more than the configured threshold
+func checkAnomaly(sensor string, value common.Value, datetime time.Time) {
+	if !cfg.Anomaly.Enabled || (value.Type != "" && value.Type != "number") {
+		return
+	}
+	val, err := parseNumber(value.Value)
+	if err != nil {
+		return
+	}
+
+	anomalyMutex.Lock()
+	defer anomalyMutex.Unlock()
+
+	b := getBaseline(sensor, datetime)
+	if !b.ok {
+		return
+	}
+	score := (val - b.center) / b.spread
+	if math.Abs(score) < cfg.Anomaly.Threshold {
+		anomalous[sensor] = false
+		return
+	}
+	if anomalous[sensor] {
+		return
+	}
+	anomalous[sensor] = true
+
+	name := value.Name
+	if name == "" {
+		name = sensor
+	}
+	evt := common.Event{
+		ID:       sensor,
+		Message:  fmt.Sprintf("%s is unusual for this time of the day (%v, expected %.2f ± %.2f)", name, val, b.center, b.spread),
+		Priority: 1,
+		Time:     &datetime,
+	}
+	go echo("[anomaly] " + evt.Message)
+	addEvent(evt)
+}
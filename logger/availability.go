@@ -0,0 +1,124 @@
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/conejoninja/home/command"
+	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/homeassistant"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	online  = "online"
+	offline = "offline"
+)
+
+type availabilityMessage struct {
+	Type         string     `json:"type"`
+	Device       string     `json:"device"`
+	Availability string     `json:"availability"`
+	Time         *time.Time `json:"time,omitempty"`
+}
+
+// availability of every device seen, including the ones not discovered yet
+var availability = make(map[string]string)
+var availabilityMutex sync.Mutex
+
+// parseAvailability accepts the usual birth and last will payloads
+func parseAvailability(payload []byte) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(string(payload))) {
+	case "online", "1", "true", "up", "connected":
+		return online, true
+	case "offline", "0", "false", "down", "disconnected", "lost":
+		return offline, true
+	}
+	return "", false
+}
+
+// availabilityHandler tracks the birth and last will messages of a device
+func availabilityHandler(deviceID string, msg mqtt.Message) {
+	go echo("[" + msg.Topic() + "] " + string(msg.Payload()))
+	state, ok := parseAvailability(msg.Payload())
+	if !ok {
+		deadLetter(msg, errors.New("unknown availability"))
+		return
+	}
+	setAvailability(deviceID, state)
+}
+
+// setAvailability stores the transitions of a device as events and in its descriptor
+func setAvailability(deviceID, state string) {
+	if state == online {
+		command.Online(deviceID)
+	} else {
+		command.Offline(deviceID)
+	}
+
+	availabilityMutex.Lock()
+	previous := availability[deviceID]
+	availability[deviceID] = state
+	availabilityMutex.Unlock()
+	if previous == state {
+		return
+	}
+
+	now := time.Now()
+	device := db.GetDevice([]byte(deviceID))
+	if !device.IsNil() {
+		device.Availability = state
+		device.AvailabilitySince = &now
+		db.AddDevice([]byte(deviceID), device)
+		homeassistant.PublishAvailability(device)
+	}
+
+	name := device.Name
+	if name == "" {
+		name = deviceID
+	}
+	evt := common.Event{
+		ID:      deviceID,
+		Message: name + " is " + state,
+		Time:    &now,
+	}
+	if state == offline {
+		evt.Priority = 1
+	}
+	addEvent(evt)
+
+	broadcastJSON(availabilityMessage{
+		Type:         "availability",
+		Device:       deviceID,
+		Availability: state,
+		Time:         &now,
+	})
+}
+
+// getAvailability returns the availability of a device
+func getAvailability(deviceID string) string {
+	availabilityMutex.Lock()
+	defer availabilityMutex.Unlock()
+	return availability[deviceID]
+}
+
+// availabilitySnapshot returns the messages with the current availability of every device
+func availabilitySnapshot() [][]byte {
+	availabilityMutex.Lock()
+	defer availabilityMutex.Unlock()
+	messages := make([][]byte, 0, len(availability))
+	for deviceID, state := range availability {
+		payload, err := json.Marshal(availabilityMessage{
+			Type:         "availability",
+			Device:       deviceID,
+			Availability: state,
+		})
+		if err == nil {
+			messages = append(messages, payload)
+		}
+	}
+	return messages
+}
@@ -0,0 +1,87 @@
+package logger
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/conejoninja/home/common"
+)
+
+// compression keeps the last stored reading of a sensor, and the last one dropped after it
+type compression struct {
+	stored common.Value
+	at     time.Time
+	held   *common.Value
+}
+
+var compressions = make(map[string]*compression)
+var compressionsMutex sync.Mutex
+
+// deadband returns the readings to store. Readings that didn't change are held back, and the last
+// held one is stored right before a change so the series could still be rebuilt step-wise
+func deadband(sensor string, value common.Value, datetime time.Time) []common.Value {
+	band, ok := cfg.Deadband[sensor]
+	if !ok {
+		if band, ok = cfg.Deadband["default"]; !ok {
+			return []common.Value{value}
+		}
+	}
+
+	t := datetime
+	value.Time = &t
+
+	compressionsMutex.Lock()
+	defer compressionsMutex.Unlock()
+
+	last, ok := compressions[sensor]
+	if !ok {
+		compressions[sensor] = &compression{stored: value, at: datetime}
+		return []common.Value{value}
+	}
+
+	if unchanged(band, last.stored.Value, value.Value) && (band.Interval == 0 || datetime.Sub(last.at) < band.Interval) {
+		last.held = &value
+		return nil
+	}
+
+	stored := make([]common.Value, 0, 2)
+	if last.held != nil && !unchanged(band, last.stored.Value, value.Value) {
+		stored = append(stored, *last.held)
+	}
+	stored = append(stored, value)
+	last.stored = value
+	last.at = datetime
+	last.held = nil
+	return stored
+}
+
+// flushDeadband stores the readings held back, so nothing is lost when stopping
+func flushDeadband() {
+	compressionsMutex.Lock()
+	defer compressionsMutex.Unlock()
+	for sensor, last := range compressions {
+		if last.held == nil {
+			continue
+		}
+		db.AddValue(strings.TrimSuffix(sensor, "-"+last.held.ID), *last.held)
+		last.stored = *last.held
+		last.held = nil
+	}
+}
+
+// unchanged checks if a reading is within the deadband of the previous one
+func unchanged(band common.Deadband, previous, current interface{}) bool {
+	prev, errPrev := parseNumber(previous)
+	curr, errCurr := parseNumber(current)
+	if errPrev != nil || errCurr != nil {
+		return fmt.Sprint(previous) == fmt.Sprint(current)
+	}
+	width := band.Absolute
+	if pct := math.Abs(prev) * band.Percent / 100; pct > width {
+		width = pct
+	}
+	return math.Abs(curr-prev) <= width
+}
@@ -0,0 +1,75 @@
+package logger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/conejoninja/home/common"
+)
+
+func TestDeadband(t *testing.T) {
+	cfg.Deadband = map[string]common.Deadband{
+		"default": {Absolute: 0.5, Interval: time.Hour},
+	}
+	compressions = make(map[string]*compression)
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		minutes int
+		value   interface{}
+		stored  []interface{}
+	}{
+		{0, 20.0, []interface{}{20.0}},
+		{1, 20.2, nil},
+		{2, 20.4, nil},
+		// the last held reading is stored before the change, so the series is still step-wise
+		{3, 21.0, []interface{}{20.4, 21.0}},
+		{4, 21.1, nil},
+		// a reading is stored at least every interval
+		{64, 21.1, []interface{}{21.1}},
+		{65, "21.2", nil},
+	}
+	for _, test := range tests {
+		stored := deadband("garden-temperature", common.Value{ID: "temperature", Value: test.value}, start.Add(time.Duration(test.minutes)*time.Minute))
+		if len(stored) != len(test.stored) {
+			t.Fatalf("minute %d: stored %v, want %v", test.minutes, stored, test.stored)
+		}
+		for k, v := range stored {
+			if v.Value != test.stored[k] {
+				t.Errorf("minute %d: stored %v, want %v", test.minutes, v.Value, test.stored[k])
+			}
+		}
+	}
+}
+
+func TestDeadbandDisabled(t *testing.T) {
+	cfg.Deadband = map[string]common.Deadband{}
+	compressions = make(map[string]*compression)
+	now := time.Now()
+	for k := 0; k < 3; k++ {
+		if stored := deadband("garden-temperature", common.Value{ID: "temperature", Value: 20.0}, now); len(stored) != 1 {
+			t.Errorf("reading %d: stored %v", k, stored)
+		}
+	}
+}
+
+func TestUnchanged(t *testing.T) {
+	tests := []struct {
+		band              common.Deadband
+		previous, current interface{}
+		unchanged         bool
+	}{
+		{common.Deadband{Absolute: 1}, 20.0, 20.5, true},
+		{common.Deadband{Absolute: 1}, 20.0, 21.5, false},
+		{common.Deadband{Percent: 10}, 100.0, 109.0, true},
+		{common.Deadband{Percent: 10}, 100.0, 111.0, false},
+		{common.Deadband{Absolute: 1}, "20", 20.5, true},
+		{common.Deadband{}, "open", "open", true},
+		{common.Deadband{}, "open", "closed", false},
+	}
+	for _, test := range tests {
+		if unchanged(test.band, test.previous, test.current) != test.unchanged {
+			t.Errorf("unchanged(%+v, %v, %v) should be %v", test.band, test.previous, test.current, test.unchanged)
+		}
+	}
+}
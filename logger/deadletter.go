@@ -0,0 +1,59 @@
+package logger
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/metrics"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// message is a MQTT message rebuilt from a dead letter to replay it
+type message struct {
+	topic   string
+	payload []byte
+}
+
+func (m *message) Duplicate() bool   { return false }
+func (m *message) Qos() byte         { return 0 }
+func (m *message) Retained() bool    { return false }
+func (m *message) Topic() string     { return m.topic }
+func (m *message) MessageID() uint16 { return 0 }
+func (m *message) Payload() []byte   { return m.payload }
+func (m *message) Ack()              {}
+
+// deadLetter keeps a message that couldn't be parsed
+func deadLetter(msg mqtt.Message, reason error) {
+	go echo("[dead letter] " + msg.Topic() + ": " + reason.Error())
+	metrics.DecodeFailed(msg.Topic())
+	if cfg.DeadLetters == 0 {
+		return
+	}
+	now := time.Now()
+	db.AddDeadLetter(common.DeadLetter{
+		Topic:   msg.Topic(),
+		Payload: msg.Payload(),
+		Error:   reason.Error(),
+		Time:    &now,
+	}, cfg.DeadLetters)
+}
+
+// Replay handles again a message that couldn't be parsed, after fixing its decoder for example.
+// It's stored again as a new dead letter if it still fails, and it's not counted as received
+func Replay(id string) error {
+	dl := db.GetDeadLetter(id)
+	if dl.ID == "" {
+		return errors.New("Dead letter not found")
+	}
+	db.DeleteDeadLetter(id)
+
+	msg := &message{topic: dl.Topic, payload: dl.Payload}
+	if cfg.Homie.Enabled && strings.HasPrefix(dl.Topic, cfg.Homie.Prefix+"/") {
+		homie(msg)
+	} else {
+		route(c, msg)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/conejoninja/home/command"
+	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/connection"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// homieNode keeps the attributes of a node and of its properties
+type homieNode struct {
+	attrs      map[string]string
+	properties map[string]map[string]string
+}
+
+// homieDevice keeps the attributes received of a Homie device until it's complete
+type homieDevice struct {
+	attrs map[string]string
+	nodes map[string]*homieNode
+}
+
+var homieDevices = make(map[string]*homieDevice)
+var homieMutex sync.Mutex
+
+// startHomie subscribes to the devices following the Homie convention
+func startHomie() {
+	if !cfg.Homie.Enabled {
+		return
+	}
+	connection.Subscribe(map[string]byte{cfg.Homie.Prefix + "/#": connection.QoS()}, homieHandler)
+}
+
+// homieHandler counts the messages received and handles them
+var homieHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	received(msg.Topic())
+	homie(msg)
+}
+
+// homie maps the $-attributes to the descriptor of the device, and the properties to its values
+func homie(msg mqtt.Message) {
+	// <prefix>/<device>/$attribute[/...], <prefix>/<device>/<node>/$attribute,
+	// <prefix>/<device>/<node>/<property>[/$attribute]
+	parts := strings.Split(strings.TrimPrefix(msg.Topic(), cfg.Homie.Prefix+"/"), "/")
+	if len(parts) < 2 || strings.HasPrefix(parts[0], "$") {
+		return
+	}
+	payload := string(msg.Payload())
+
+	homieMutex.Lock()
+	hd, ok := homieDevices[parts[0]]
+	if !ok {
+		hd = &homieDevice{attrs: make(map[string]string), nodes: make(map[string]*homieNode)}
+		homieDevices[parts[0]] = hd
+	}
+
+	switch {
+	case strings.HasPrefix(parts[1], "$"):
+		// device attributes could be nested, like $fw/version or $stats/uptime
+		hd.attrs[strings.Join(parts[1:], "/")] = payload
+	case len(parts) == 3 && strings.HasPrefix(parts[2], "$"):
+		homieGetNode(hd, parts[1]).attrs[parts[2]] = payload
+	case len(parts) == 4 && strings.HasPrefix(parts[3], "$"):
+		homieGetProperty(hd, parts[1], parts[2])[parts[3]] = payload
+	case len(parts) == 3:
+		device := homieDescriptor(parts[0], hd)
+		property := homieGetProperty(hd, parts[1], parts[2])
+		datatype := property["$datatype"]
+		value := common.Value{
+			ID:   parts[1] + "-" + parts[2],
+			Type: homieType(datatype),
+			Name: property["$name"],
+			Unit: property["$unit"],
+		}
+		homieMutex.Unlock()
+		val, err := homieValue(datatype, payload)
+		if err != nil {
+			deadLetter(msg, err)
+			return
+		}
+		// the broker sends the retained values again on every subscription, they are only new
+		// if they changed since the last one stored
+		if msg.Retained() {
+			last := db.GetLastValue(device.ID + "-" + value.ID)
+			if last.Value != nil && fmt.Sprint(last.Value) == fmt.Sprint(val) {
+				return
+			}
+		}
+		go echo("[" + msg.Topic() + "] " + payload)
+		value.Value = val
+		ingestValue(device, value)
+		return
+	default:
+		// set topics, and anything else we don't know about
+		homieMutex.Unlock()
+		return
+	}
+
+	device := homieDescriptor(parts[0], hd)
+	_, named := hd.attrs["$name"]
+	homieMutex.Unlock()
+
+	if parts[1] == "$state" {
+		switch payload {
+		case "ready":
+			setAvailability(device.ID, online)
+		case "disconnected", "lost":
+			setAvailability(device.ID, offline)
+		}
+	}
+	// Wait for the device to announce its name before storing it
+	if !named {
+		return
+	}
+	stored := db.GetDevice([]byte(device.ID))
+	device.Availability = stored.Availability
+	device.AvailabilitySince = stored.AvailabilitySince
+	db.AddDevice([]byte(device.ID), device)
+	setKnown(device.ID)
+	command.Handle(device.ID, homieCall)
+}
+
+func homieGetNode(hd *homieDevice, id string) *homieNode {
+	node, ok := hd.nodes[id]
+	if !ok {
+		node = &homieNode{attrs: make(map[string]string), properties: make(map[string]map[string]string)}
+		hd.nodes[id] = node
+	}
+	return node
+}
+
+func homieGetProperty(hd *homieDevice, nodeID, id string) map[string]string {
+	node := homieGetNode(hd, nodeID)
+	property, ok := node.properties[id]
+	if !ok {
+		property = make(map[string]string)
+		node.properties[id] = property
+	}
+	return property
+}
+
+// homieDescriptor builds the descriptor of a device from its attributes, the properties are the values
+// of the device and the settable ones are methods too
+func homieDescriptor(id string, hd *homieDevice) common.Device {
+	device := common.Device{
+		ID:      id,
+		Name:    hd.attrs["$name"],
+		Version: hd.attrs["$fw/version"],
+	}
+	if device.Version == "" {
+		device.Version = hd.attrs["$homie"]
+	}
+	// Only the nodes listed by the device, in its order, if it already sent them
+	nodes := strings.Split(hd.attrs["$nodes"], ",")
+	if hd.attrs["$nodes"] == "" {
+		nodes = nil
+		for nodeID := range hd.nodes {
+			nodes = append(nodes, nodeID)
+		}
+	}
+	for _, nodeID := range nodes {
+		node, ok := hd.nodes[nodeID]
+		if !ok {
+			continue
+		}
+		properties := strings.Split(node.attrs["$properties"], ",")
+		if node.attrs["$properties"] == "" {
+			properties = nil
+			for propertyID := range node.properties {
+				properties = append(properties, propertyID)
+			}
+		}
+		for _, propertyID := range properties {
+			property, ok := node.properties[propertyID]
+			if !ok {
+				continue
+			}
+			value := common.Value{
+				ID:   nodeID + "-" + propertyID,
+				Type: homieType(property["$datatype"]),
+				Name: property["$name"],
+				Unit: property["$unit"],
+			}
+			if value.Type == "number" {
+				if format := strings.SplitN(property["$format"], ":", 2); len(format) == 2 {
+					value.Min = format[0]
+					value.Max = format[1]
+				}
+			}
+			device.Out = append(device.Out, value)
+			if property["$settable"] == "true" {
+				param := value
+				param.ID = "value"
+				device.Methods = append(device.Methods, common.Method{
+					Name:   "set-" + value.ID,
+					Params: []common.Value{param},
+				})
+			}
+		}
+	}
+	return device
+}
+
+// homieType maps the datatypes of Homie to the types of the values
+func homieType(datatype string) string {
+	switch datatype {
+	case "integer", "float":
+		return "number"
+	case "boolean":
+		return "bool"
+	case "":
+		return ""
+	}
+	return "string"
+}
+
+// homieValue parses the payload of a property, Homie sends everything as strings
+func homieValue(datatype, payload string) (interface{}, error) {
+	switch datatype {
+	case "integer", "float", "":
+		if val, err := strconv.ParseFloat(payload, 64); err == nil {
+			return val, nil
+		} else if datatype != "" {
+			return nil, err
+		}
+	case "boolean":
+		return strconv.ParseBool(payload)
+	}
+	return payload, nil
+}
+
+// homieCall publishes a method to the set topic of its property
+func homieCall(deviceID string, method common.Method) error {
+	if !strings.HasPrefix(method.Name, "set-") {
+		return fmt.Errorf("unknown method %s", method.Name)
+	}
+	id := strings.TrimPrefix(method.Name, "set-")
+
+	homieMutex.Lock()
+	topic := ""
+	if hd, ok := homieDevices[deviceID]; ok {
+		for nodeID, node := range hd.nodes {
+			for propertyID, property := range node.properties {
+				if nodeID+"-"+propertyID == id && property["$settable"] == "true" {
+					topic = cfg.Homie.Prefix + "/" + deviceID + "/" + nodeID + "/" + propertyID + "/set"
+				}
+			}
+		}
+	}
+	homieMutex.Unlock()
+	if topic == "" {
+		return fmt.Errorf("%s is not settable", id)
+	}
+
+	for _, param := range method.Params {
+		if param.ID == "value" || len(method.Params) == 1 {
+			return command.Publish(topic, fmt.Sprint(param.Value), false)
+		}
+	}
+	return errors.New("missing value")
+}
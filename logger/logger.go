@@ -1,8 +1,10 @@
 package logger
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"os"
+	"sync"
 
 	"encoding/json"
 
@@ -11,7 +13,14 @@ import (
 
 	"time"
 
+	"github.com/conejoninja/home/command"
 	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/connection"
+	"github.com/conejoninja/home/decoder"
+	"github.com/conejoninja/home/homeassistant"
+	"github.com/conejoninja/home/metrics"
+	"github.com/conejoninja/home/rules"
+	"github.com/conejoninja/home/shadow"
 	"github.com/conejoninja/home/storage"
 	"github.com/conejoninja/home/telegram"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -23,11 +32,15 @@ var c mqtt.Client
 var cfg common.HomeConfig
 
 // MQTT
-var subscriptions map[string]bool
-var token mqtt.Token
+// devices whose values are stored, every other topic matching the values template is ignored. The
+// dead letters are replayed from the API, so it's guarded too
+var known map[string]bool
+var knownMutex sync.Mutex
 
 // WEBSOCKETS
+var server *http.Server
 var clients = make(map[*websocket.Conn]bool)
+var clientsMutex sync.Mutex
 var broadcast = make(chan []byte)
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
@@ -41,32 +54,36 @@ func Start(homecfg common.HomeConfig, dbcon storage.Storage, mqttclient mqtt.Cli
 	db = dbcon
 	c = mqttclient
 
-	subscriptions = make(map[string]bool)
+	knownMutex.Lock()
+	known = make(map[string]bool)
+	knownMutex.Unlock()
 
-	restartDevices()
-
-	// Discover new devices when they connect to the network
-	if token = c.Subscribe("discovery", 0, discoveryHandler); token.Wait() && token.Error() != nil {
-		fmt.Println(token.Error())
-		os.Exit(1)
-	}
+	metrics.Gauge("home_websocket_clients", "Websocket clients connected.", func() float64 {
+		clientsMutex.Lock()
+		defer clientsMutex.Unlock()
+		return float64(len(clients))
+	})
 
-	if token = c.Subscribe("events", 0, eventsHandler); token.Wait() && token.Error() != nil {
-		fmt.Println(token.Error())
-		os.Exit(1)
-	}
+	startVirtual()
+	restartDevices()
+	subscribe()
+	startHomie()
 
 	if cfg.WS.Enabled {
 		http.HandleFunc("/ws", handleConnections)
 
 		go handleMessages()
 
+		server = &http.Server{Addr: ":" + cfg.WS.Port}
 		go func() {
 			for {
 				go echo("WebSocket server started on: " + cfg.WS.Port)
-				err := http.ListenAndServe(":"+cfg.WS.Port, nil)
+				err := server.ListenAndServe()
+				if err == http.ErrServerClosed {
+					return
+				}
 				if err != nil {
-					log.Fatal("ListenAndServe: ", err)
+					fmt.Println("ListenAndServe: ", err)
 					fmt.Println("(╯°□°)╯ API server failed, restarting in...")
 				}
 				time.Sleep(5 * time.Second)
@@ -77,16 +94,77 @@ func Start(homecfg common.HomeConfig, dbcon storage.Storage, mqttclient mqtt.Cli
 	fmt.Println("END")
 }
 
+// Stop stops the websocket server and closes its clients, waiting until the context is done, and
+// stores the readings held back by the deadband so the series end at their last value. It's called
+// once disconnected from the broker, so no reading is held back after the flush
+func Stop(ctx context.Context) error {
+	flushDeadband()
+	if server == nil {
+		return nil
+	}
+	err := server.Shutdown(ctx)
+	clientsMutex.Lock()
+	for client := range clients {
+		client.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"), time.Now().Add(time.Second))
+		client.Close()
+		delete(clients, client)
+	}
+	clientsMutex.Unlock()
+	return err
+}
+
 func restartDevices() {
 	devices := db.GetDevices()
 	for _, device := range devices {
-		subscriptions[device.ID] = true
-		go echo("Subscribed to " + device.ID)
-		if token = c.Subscribe(device.ID, 0, defaultHandler); token.WaitTimeout(10*time.Second) && token.Error() != nil {
-			subscriptions[device.ID] = false
-			go echo(fmt.Sprintln(token.Error()))
-			os.Exit(1)
+		if device.ID == virtualDevice {
+			continue
+		}
+		setKnown(device.ID)
+		for _, out := range device.Out {
+			last := db.GetLastValue(device.ID + "-" + out.ID)
+			if val, err := parseNumber(last.Value); err == nil && (out.Type == "" || out.Type == "number") {
+				metrics.Sensor(device.ID, out.ID, unit(device, out), val)
+			}
+		}
+		if device.Availability != "" {
+			availability[device.ID] = device.Availability
+		}
+		if device.Availability == offline {
+			command.Offline(device.ID)
+		}
+	}
+}
+
+// subscribe to the values of every device with a single wildcard, and to discovery, events and
+// availability if the wildcard doesn't already match them
+func subscribe() {
+	filters := map[string]byte{common.WildcardTopic(cfg.MQTT.ValuesTopic): connection.QoS()}
+	for _, topic := range []string{cfg.MQTT.DiscoveryTopic, cfg.MQTT.EventsTopic, common.WildcardTopic(cfg.MQTT.AvailabilityTopic)} {
+		if !common.TopicMatches(common.WildcardTopic(cfg.MQTT.ValuesTopic), topic) {
+			filters[topic] = connection.QoS()
+		}
+	}
+	connection.Subscribe(filters, routeHandler)
+}
+
+// routeHandler counts the messages received and dispatches them by their topic
+var routeHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	received(msg.Topic())
+	route(client, msg)
+}
 
+// route dispatches a message by its topic
+func route(client mqtt.Client, msg mqtt.Message) {
+	switch msg.Topic() {
+	case cfg.MQTT.DiscoveryTopic:
+		discoveryHandler(client, msg)
+	case cfg.MQTT.EventsTopic:
+		eventsHandler(client, msg)
+	default:
+		if device, ok := common.TopicDevice(cfg.MQTT.AvailabilityTopic, msg.Topic()); ok {
+			availabilityHandler(device, msg)
+		} else if device, ok := common.TopicDevice(cfg.MQTT.ValuesTopic, msg.Topic()); ok && isKnown(device) {
+			valuesHandler(device, msg)
 		}
 	}
 }
@@ -95,50 +173,141 @@ var discoveryHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Mes
 	go echo("[" + msg.Topic() + "] " + string(msg.Payload()))
 	var device common.Device
 	err := json.Unmarshal(msg.Payload(), &device)
+	if err == nil && device.ID == "" {
+		err = errors.New("missing device id")
+	}
 	if err == nil {
-		db.AddDevice([]byte(device.ID), device)
-		if v, ok := subscriptions[device.ID]; !ok || !v {
-			subscriptions[device.ID] = true
-			if token = c.Subscribe(device.ID, 0, defaultHandler); token.Wait() && token.Error() != nil {
-				subscriptions[device.ID] = false
-				fmt.Println(token.Error())
-				os.Exit(1)
-			}
-
+		// The availability is not part of the descriptor sent by the device
+		stored := db.GetDevice([]byte(device.ID))
+		device.Availability = stored.Availability
+		device.AvailabilitySince = stored.AvailabilitySince
+		if state := getAvailability(device.ID); state != "" && state != device.Availability {
+			now := time.Now()
+			device.Availability = state
+			device.AvailabilitySince = &now
 		}
+		db.AddDevice([]byte(device.ID), device)
+		setKnown(device.ID)
+		homeassistant.PublishDevice(device)
 	} else {
-		fmt.Println(err)
+		deadLetter(msg, err)
 	}
 }
 
+func isKnown(device string) bool {
+	knownMutex.Lock()
+	defer knownMutex.Unlock()
+	return known[device]
+}
+
+func setKnown(device string) {
+	knownMutex.Lock()
+	known[device] = true
+	knownMutex.Unlock()
+}
+
 var eventsHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
 	go echo("[" + msg.Topic() + "] " + string(msg.Payload()))
 	var evt common.Event
 	err := json.Unmarshal(msg.Payload(), &evt)
 	if err == nil {
-		db.AddEvent(evt.ID, evt)
-		telegram.NotifyEvent(evt)
+		addEvent(evt)
 	} else {
-		fmt.Println(err)
+		deadLetter(msg, err)
 	}
 }
 
-var defaultHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+// valuesHandler stores the values sent by a device
+func valuesHandler(deviceID string, msg mqtt.Message) {
 	go echo("[" + msg.Topic() + "] " + string(msg.Payload()))
-	var values []common.Value
-	err := json.Unmarshal(msg.Payload(), &values)
+	device := db.GetDevice([]byte(deviceID))
+	device.ID = deviceID
+	format := cfg.Decoders[deviceID]
+	if format == "" {
+		format = device.Format
+	}
+	values, err := decoder.Decode(format, device, msg.Payload())
 	if err == nil {
 		for _, value := range values {
-			db.AddValue(msg.Topic(), value)
-			datetime := time.Now()
-			if value.Time != nil && !(*value.Time).IsZero() {
-				datetime = *value.Time
-			}
-			CalculateMetaAll(msg.Topic()+"-"+value.ID, datetime)
+			ingestValue(device, value)
 		}
 	} else {
-		fmt.Println(err)
+		deadLetter(msg, err)
+	}
+}
+
+// ingestValue applies the validation policy to a value sent by a device and stores it
+func ingestValue(device common.Device, value common.Value) {
+	// a device sending values is online, even if it doesn't send birth messages
+	command.Online(device.ID)
+	datetime := time.Now()
+	if value.Time != nil && !(*value.Time).IsZero() {
+		datetime = *value.Time
+	}
+	if cfg.Validation != policyAccept {
+		if err := validate(device, value); err != nil {
+			if cfg.Validation == policyQuarantine {
+				// out of range readings are still real, and should raise their alerts
+				checkAlerts(device, value, datetime)
+				quarantine(device.ID, value, err, datetime)
+				return
+			}
+			value.Invalid = err.Error()
+		}
+	}
+	addValue(device, value, datetime)
+}
+
+// addValue stores a value and updates everything that depends on it
+func addValue(device common.Device, value common.Value, datetime time.Time) {
+	sensor := device.ID + "-" + value.ID
+	if value.Invalid != "" {
+		storeValue(device.ID, value)
+		checkAlerts(device, value, datetime)
+		return
+	}
+	// the deadband only saves storage, every reading counts for the meta and the alerts
+	for _, v := range deadband(sensor, value, datetime) {
+		storeValue(device.ID, v)
+	}
+	if val, err := parseNumber(value.Value); err == nil && (value.Type == "" || value.Type == "number") {
+		metrics.Sensor(device.ID, value.ID, unit(device, value), val)
+		UpdateMetaAll(sensor, val, datetime.In(cfg.Location))
+	}
+	shadow.Report(device.ID, value)
+	checkAlerts(device, value, datetime)
+	rules.ProcessValue(sensor, value, datetime)
+	homeassistant.PublishValue(device.ID, value)
+	updateVirtual(sensor, datetime)
+}
+
+// checkAlerts compares a value against the thresholds and the usual readings of its sensor
+func checkAlerts(device common.Device, value common.Value, datetime time.Time) {
+	checkThreshold(device, value, datetime)
+	checkAnomaly(device.ID+"-"+value.ID, value, datetime)
+}
+
+// storeValue stores a value, timing the write
+func storeValue(deviceID string, value common.Value) {
+	start := time.Now()
+	db.AddValue(deviceID, value)
+	metrics.StorageWrite(time.Since(start))
+}
+
+// unit returns the unit of a value as declared by its device
+func unit(device common.Device, value common.Value) string {
+	for _, out := range device.Out {
+		if out.ID == value.ID && out.Unit != "" {
+			return out.Unit
+		}
 	}
+	return value.Unit
+}
+
+func addEvent(evt common.Event) {
+	db.AddEvent(evt.ID, evt)
+	telegram.NotifyEvent(evt)
+	rules.ProcessEvent(evt)
 }
 
 /**
@@ -150,13 +319,19 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 		log.Fatal(err)
 	}
 
+	for _, msg := range availabilitySnapshot() {
+		ws.WriteMessage(websocket.TextMessage, msg)
+	}
+	clientsMutex.Lock()
 	clients[ws] = true
+	clientsMutex.Unlock()
 
 }
 
 func handleMessages() {
 	for {
 		msg := <-broadcast
+		clientsMutex.Lock()
 		for client := range clients {
 			err := client.WriteMessage(1, msg)
 			if err != nil {
@@ -165,7 +340,22 @@ func handleMessages() {
 				delete(clients, client)
 			}
 		}
+		clientsMutex.Unlock()
+	}
+}
+
+// broadcastJSON sends a message to every websocket client
+func broadcastJSON(v interface{}) {
+	if !cfg.WS.Enabled {
+		return
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return
 	}
+	go func() {
+		broadcast <- payload
+	}()
 }
 
 func echo(s string) {
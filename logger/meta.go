@@ -2,6 +2,7 @@ package logger
 
 import (
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/conejoninja/home/common"
@@ -16,22 +17,25 @@ func CalculateMeta(sensor string, start, end time.Time, prefix string) {
 	if len(values) > 0 {
 		defVal := values[0]
 		if defVal.Type == "" || defVal.Type == "number" {
-			val, _ := common.GetFloat(values[0].Value)
-			meta.Max = val
-			meta.Min = val
 			var tmpVal float64
 			for _, value := range values {
+				// Values tagged as invalid are kept but don't count
+				if value.Invalid != "" {
+					continue
+				}
 				val, _ := common.GetFloat(value.Value)
-				if val > meta.Max {
+				if meta.N == 0 || val > meta.Max {
 					meta.Max = val
 				}
-				if val < meta.Min {
+				if meta.N == 0 || val < meta.Min {
 					meta.Min = val
 				}
 				tmpVal += val
 				meta.N++
 			}
-			meta.Avg = tmpVal / float64(meta.N)
+			if meta.N > 0 {
+				meta.Avg = tmpVal / float64(meta.N)
+			}
 		}
 		db.AddMeta([]byte(sensor+"-"+prefix+strconv.Itoa(int(start.Unix()))), meta)
 	}
@@ -69,8 +73,50 @@ func CalculateMetaMonth(sensor string, start time.Time) {
 }
 
 func CalculateMetaAll(sensor string, start time.Time) {
-	//CalculateMetaHour(sensor, start)
+	// Hourly meta is the baseline of the anomaly detection
+	if cfg.Anomaly.Enabled {
+		CalculateMetaHour(sensor, start)
+	}
 	CalculateMetaDay(sensor, start)
 	CalculateMetaWeek(sensor, start)
 	CalculateMetaMonth(sensor, start)
 }
+
+var metaMutex sync.Mutex
+
+// UpdateMetaAll adds a reading to the meta of every period it's in. Every reading counts, even the
+// ones the deadband doesn't store, so the meta and the anomaly baselines see them all
+func UpdateMetaAll(sensor string, val float64, datetime time.Time) {
+	hour := time.Date(datetime.Year(), datetime.Month(), datetime.Day(), datetime.Hour(), 0, 0, 0, cfg.Location)
+	day := time.Date(datetime.Year(), datetime.Month(), datetime.Day(), 0, 0, 0, 0, cfg.Location)
+	weekday := int(datetime.Weekday())
+	if weekday == 0 {
+		weekday = 7
+	}
+	week := time.Date(datetime.Year(), datetime.Month(), datetime.Day()-(weekday-1), 0, 0, 0, 0, cfg.Location)
+	month := time.Date(datetime.Year(), datetime.Month(), 1, 0, 0, 0, 0, cfg.Location)
+
+	metaMutex.Lock()
+	defer metaMutex.Unlock()
+	// Hourly meta is the baseline of the anomaly detection
+	if cfg.Anomaly.Enabled {
+		updateMeta(sensor+"-hour-"+strconv.Itoa(int(hour.Unix())), val)
+	}
+	updateMeta(sensor+"-day-"+strconv.Itoa(int(day.Unix())), val)
+	updateMeta(sensor+"-week-"+strconv.Itoa(int(week.Unix())), val)
+	updateMeta(sensor+"-month-"+strconv.Itoa(int(month.Unix())), val)
+}
+
+// updateMeta adds a reading to the maximum, minimum and average of a period
+func updateMeta(key string, val float64) {
+	meta := db.GetMeta([]byte(key))
+	if meta.N == 0 || val > meta.Max {
+		meta.Max = val
+	}
+	if meta.N == 0 || val < meta.Min {
+		meta.Min = val
+	}
+	meta.Avg = (meta.Avg*float64(meta.N) + val) / float64(meta.N+1)
+	meta.N++
+	db.AddMeta([]byte(key), meta)
+}
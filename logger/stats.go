@@ -0,0 +1,62 @@
+package logger
+
+import (
+	"sync"
+	"time"
+
+	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/metrics"
+)
+
+// messages received in each second of the last minute, to compute the ingestion rate
+var perSecond [60]uint64
+var lastSecond int64
+var messages uint64
+var lastMessage time.Time
+var statsMutex sync.Mutex
+
+// received counts a message received from the broker
+func received(topic string) {
+	metrics.MessageReceived(topic)
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	now := time.Now()
+	advance(now.Unix())
+	perSecond[now.Unix()%60]++
+	messages++
+	lastMessage = now
+}
+
+// advance clears the buckets of the seconds without messages since the last one
+func advance(second int64) {
+	if second-lastSecond >= 60 {
+		perSecond = [60]uint64{}
+	} else {
+		for s := lastSecond + 1; s <= second; s++ {
+			perSecond[s%60] = 0
+		}
+	}
+	if second > lastSecond {
+		lastSecond = second
+	}
+}
+
+// Ingestion returns the messages received, their rate and the time of the last one
+func Ingestion() common.IngestionStatus {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	advance(time.Now().Unix())
+	var total uint64
+	for _, n := range perSecond {
+		total += n
+	}
+	status := common.IngestionStatus{
+		Messages: messages,
+		Rate:     float64(total) / 60,
+	}
+	if !lastMessage.IsZero() {
+		t := lastMessage
+		status.LastMessage = &t
+	}
+	return status
+}
@@ -0,0 +1,132 @@
+package logger
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/conejoninja/home/common"
+)
+
+const (
+	levelOK   = 0
+	levelLow  = -1
+	levelHigh = 1
+)
+
+// alertState keeps track of the alert level of a sensor, and the level it is
+// trying to reach while it's being debounced
+type alertState struct {
+	level   int
+	pending int
+	since   time.Time
+}
+
+var alerts = make(map[string]*alertState)
+var alertsMutex sync.Mutex
+
+// getLimits returns the thresholds of a sensor, user config takes precedence
+// over the Min and Max declared by the device
+func getLimits(device common.Device, value common.Value) (min, max string, hysteresis float64, debounce time.Duration) {
+	for _, out := range device.Out {
+		if out.ID == value.ID {
+			min = out.Min
+			max = out.Max
+			break
+		}
+	}
+	hysteresis = cfg.Alerts.Hysteresis
+	debounce = cfg.Alerts.Debounce
+
+	if th, ok := cfg.Alerts.Thresholds[device.ID+"-"+value.ID]; ok {
+		if th.Min != "" {
+			min = th.Min
+		}
+		if th.Max != "" {
+			max = th.Max
+		}
+		if th.Hysteresis != 0 {
+			hysteresis = th.Hysteresis
+		}
+		if th.Debounce != 0 {
+			debounce = th.Debounce
+		}
+	}
+	return
+}
+
+// checkThreshold compares a value against the limits of the sensor and
+// generates an event when it crosses them
+func checkThreshold(device common.Device, value common.Value, datetime time.Time) {
+	if value.Type != "" && value.Type != "number" {
+		return
+	}
+	minStr, maxStr, hysteresis, debounce := getLimits(device, value)
+	if minStr == "" && maxStr == "" {
+		return
+	}
+	// invalid values reach here too, a missing value is not a zero
+	val, err := parseNumber(value.Value)
+	if err != nil {
+		return
+	}
+
+	sensor := device.ID + "-" + value.ID
+
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+
+	state, ok := alerts[sensor]
+	if !ok {
+		state = &alertState{}
+		alerts[sensor] = state
+	}
+
+	// Once in alert, the value needs to get back past the hysteresis band to recover
+	level := levelOK
+	if min, err := strconv.ParseFloat(minStr, 64); err == nil {
+		if val < min || (state.level == levelLow && val < min+hysteresis) {
+			level = levelLow
+		}
+	}
+	if max, err := strconv.ParseFloat(maxStr, 64); err == nil {
+		if val > max || (state.level == levelHigh && val > max-hysteresis) {
+			level = levelHigh
+		}
+	}
+
+	if level == state.level {
+		state.pending = level
+		return
+	}
+	if level != state.pending {
+		state.pending = level
+		state.since = datetime
+	}
+	if datetime.Sub(state.since) < debounce {
+		return
+	}
+	state.level = level
+
+	name := value.Name
+	if name == "" {
+		name = sensor
+	}
+	evt := common.Event{
+		ID:       sensor,
+		Priority: 1,
+		Time:     &datetime,
+	}
+	switch level {
+	case levelLow:
+		evt.Message = fmt.Sprintf("%s is below its minimum (%v < %s)", name, val, minStr)
+	case levelHigh:
+		evt.Message = fmt.Sprintf("%s is above its maximum (%v > %s)", name, val, maxStr)
+	default:
+		evt.Priority = 0
+		evt.Message = fmt.Sprintf("%s is back to normal (%v)", name, val)
+	}
+	go echo("[alert] " + evt.Message)
+	addEvent(evt)
+}
@@ -0,0 +1,82 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/conejoninja/home/common"
+)
+
+const (
+	policyAccept     = "accept"
+	policyTag        = "tag"
+	policyQuarantine = "quarantine"
+)
+
+// parseNumber returns the value as a float64, numbers sent as strings are accepted too
+func parseNumber(value interface{}) (float64, error) {
+	if str, ok := value.(string); ok {
+		return strconv.ParseFloat(str, 64)
+	}
+	if value == nil {
+		return 0, errors.New("missing value")
+	}
+	return common.GetFloat(value)
+}
+
+// validate checks a value against the descriptor of its device
+func validate(device common.Device, value common.Value) error {
+	// devices that never sent their descriptor have nothing to check against
+	if len(device.Out) == 0 {
+		return nil
+	}
+	var out *common.Value
+	for k := range device.Out {
+		if device.Out[k].ID == value.ID {
+			out = &device.Out[k]
+			break
+		}
+	}
+	if out == nil {
+		return fmt.Errorf("unknown sensor %s", value.ID)
+	}
+	if value.Type != "" && out.Type != "" && value.Type != out.Type {
+		return fmt.Errorf("type %s, expected %s", value.Type, out.Type)
+	}
+
+	switch out.Type {
+	case "", "number":
+		val, err := parseNumber(value.Value)
+		if err != nil {
+			return fmt.Errorf("not a number: %v", value.Value)
+		}
+		if min, err := strconv.ParseFloat(out.Min, 64); err == nil && val < min {
+			return fmt.Errorf("%v below minimum %s", val, out.Min)
+		}
+		if max, err := strconv.ParseFloat(out.Max, 64); err == nil && val > max {
+			return fmt.Errorf("%v above maximum %s", val, out.Max)
+		}
+	case "bool", "boolean":
+		if _, ok := value.Value.(bool); !ok {
+			return fmt.Errorf("not a boolean: %v", value.Value)
+		}
+	case "string":
+		if _, ok := value.Value.(string); !ok {
+			return fmt.Errorf("not a string: %v", value.Value)
+		}
+	}
+	return nil
+}
+
+// quarantine stores a rejected value apart from the rest
+func quarantine(device string, value common.Value, reason error, datetime time.Time) {
+	go echo("[quarantine] " + device + "-" + value.ID + ": " + reason.Error())
+	db.AddQuarantined(device, common.Quarantined{
+		Device: device,
+		Value:  value,
+		Reason: reason.Error(),
+		Time:   &datetime,
+	})
+}
@@ -0,0 +1,185 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/Knetic/govaluate"
+	"github.com/conejoninja/home/common"
+)
+
+const virtualDevice = "virtual"
+
+type virtualSensor struct {
+	def    common.VirtualSensor
+	expr   *govaluate.EvaluableExpression
+	inputs []string
+}
+
+var virtuals []virtualSensor
+
+var functions = map[string]govaluate.ExpressionFunction{
+	"abs": func(args ...interface{}) (interface{}, error) {
+		values, err := numbers("abs", args)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) != 1 {
+			return nil, errors.New("abs needs one argument")
+		}
+		return math.Abs(values[0]), nil
+	},
+	"min": func(args ...interface{}) (interface{}, error) {
+		values, err := numbers("min", args)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			return nil, errors.New("min needs at least one argument")
+		}
+		min := values[0]
+		for _, v := range values[1:] {
+			min = math.Min(min, v)
+		}
+		return min, nil
+	},
+	"max": func(args ...interface{}) (interface{}, error) {
+		values, err := numbers("max", args)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			return nil, errors.New("max needs at least one argument")
+		}
+		max := values[0]
+		for _, v := range values[1:] {
+			max = math.Max(max, v)
+		}
+		return max, nil
+	},
+	// dewpoint(temperature °C, relative humidity %) using the Magnus formula
+	"dewpoint": func(args ...interface{}) (interface{}, error) {
+		values, err := numbers("dewpoint", args)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) != 2 {
+			return nil, errors.New("dewpoint needs temperature and humidity")
+		}
+		t, rh := values[0], values[1]
+		if rh <= 0 {
+			return nil, errors.New("humidity should be positive")
+		}
+		gamma := math.Log(rh/100) + 17.62*t/(243.12+t)
+		return 243.12 * gamma / (17.62 - gamma), nil
+	},
+}
+
+// numbers checks every argument of a function is a number
+func numbers(name string, args []interface{}) ([]float64, error) {
+	values := make([]float64, len(args))
+	for k, arg := range args {
+		v, ok := arg.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%s: argument %d is not a number: %v", name, k+1, arg)
+		}
+		values[k] = v
+	}
+	return values, nil
+}
+
+// startVirtual compiles the expressions of the virtual sensors and registers the virtual device
+func startVirtual() {
+	virtuals = nil
+	device := common.Device{
+		ID:   virtualDevice,
+		Name: "Virtual sensors",
+	}
+	defined := make(map[string]bool)
+	for _, def := range cfg.Virtual {
+		expr, err := govaluate.NewEvaluableExpressionWithFunctions(def.Expression, functions)
+		if err != nil {
+			fmt.Println("Virtual sensor", def.ID, err)
+			continue
+		}
+		// Virtual sensors could only use the ones defined before them, so there are no loops
+		inputs := expr.Vars()
+		valid := true
+		for _, input := range inputs {
+			if strings.HasPrefix(input, virtualDevice+"-") && !defined[input] {
+				fmt.Println("Virtual sensor", def.ID, "uses", input, "before it's defined")
+				valid = false
+			}
+		}
+		if !valid {
+			continue
+		}
+		defined[virtualDevice+"-"+def.ID] = true
+		virtuals = append(virtuals, virtualSensor{def: def, expr: expr, inputs: inputs})
+		device.Out = append(device.Out, common.Value{
+			ID:   def.ID,
+			Type: "number",
+			Name: def.Name,
+			Unit: def.Unit,
+		})
+	}
+	if len(virtuals) > 0 {
+		db.AddDevice([]byte(virtualDevice), device)
+	}
+}
+
+// updateVirtual computes the virtual sensors that use the sensor
+func updateVirtual(sensor string, datetime time.Time) {
+	if len(virtuals) == 0 {
+		return
+	}
+	device := common.Device{ID: virtualDevice}
+	for _, v := range virtuals {
+		if !uses(v, sensor) {
+			continue
+		}
+		params := make(map[string]interface{}, len(v.inputs))
+		for _, input := range v.inputs {
+			last := db.GetLastValue(input)
+			val, err := parseNumber(last.Value)
+			if err != nil {
+				params = nil
+				break
+			}
+			params[input] = val
+		}
+		if params == nil {
+			continue
+		}
+		result, err := v.expr.Evaluate(params)
+		if err != nil {
+			fmt.Println("Virtual sensor", v.def.ID, err)
+			continue
+		}
+		val, ok := result.(float64)
+		if !ok || math.IsNaN(val) || math.IsInf(val, 0) {
+			continue
+		}
+		t := datetime
+		addValue(device, common.Value{
+			ID:    v.def.ID,
+			Type:  "number",
+			Name:  v.def.Name,
+			Unit:  v.def.Unit,
+			Time:  &t,
+			Value: val,
+		}, datetime)
+	}
+}
+
+func uses(v virtualSensor, sensor string) bool {
+	for _, input := range v.inputs {
+		if input == sensor {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buckets of the histograms, in seconds
+var buckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	values map[string]float64
+	hists  map[string]*histogram
+	fn     func() float64
+}
+
+var registry = make(map[string]*metric)
+var mutex sync.Mutex
+
+func get(name, help, kind string) *metric {
+	m, ok := registry[name]
+	if !ok {
+		m = &metric{
+			name:   name,
+			help:   help,
+			kind:   kind,
+			values: make(map[string]float64),
+			hists:  make(map[string]*histogram),
+		}
+		registry[name] = m
+	}
+	return m
+}
+
+// labels formats pairs of names and values like {device="x",sensor="y"}
+func labels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(pairs)/2)
+	for k := 0; k+1 < len(pairs); k += 2 {
+		parts = append(parts, pairs[k]+"=\""+escape(pairs[k+1])+"\"")
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+func add(name, help string, value float64, pairs ...string) {
+	mutex.Lock()
+	get(name, help, "counter").values[labels(pairs...)] += value
+	mutex.Unlock()
+}
+
+func set(name, help string, value float64, pairs ...string) {
+	mutex.Lock()
+	get(name, help, "gauge").values[labels(pairs...)] = value
+	mutex.Unlock()
+}
+
+func observe(name, help string, d time.Duration, pairs ...string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	m := get(name, help, "histogram")
+	key := labels(pairs...)
+	h, ok := m.hists[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(buckets))}
+		m.hists[key] = h
+	}
+	seconds := d.Seconds()
+	for k, le := range buckets {
+		if seconds <= le {
+			h.counts[k]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// Gauge registers a gauge whose value is read when scraped
+func Gauge(name, help string, fn func() float64) {
+	mutex.Lock()
+	get(name, help, "gauge").fn = fn
+	mutex.Unlock()
+}
+
+// MessageReceived counts a message received from the broker
+func MessageReceived(topic string) {
+	add("home_mqtt_messages_received_total", "Messages received from the broker by topic.", 1, "topic", topic)
+}
+
+// DecodeFailed counts a message that couldn't be parsed
+func DecodeFailed(topic string) {
+	add("home_decode_failures_total", "Messages that couldn't be parsed by topic.", 1, "topic", topic)
+}
+
+// StorageWrite observes the time taken to store a value
+func StorageWrite(d time.Duration) {
+	observe("home_storage_write_seconds", "Time taken to store a value.", d)
+}
+
+// Request observes the duration of a request to the API
+func Request(method, route string, code int, d time.Duration) {
+	observe("home_api_request_duration_seconds", "Duration of the requests to the API.", d,
+		"method", method, "route", route, "code", strconv.Itoa(code))
+}
+
+// Sensor sets the latest value of a numeric sensor
+func Sensor(device, sensor, unit string, value float64) {
+	set("home_sensor_value", "Latest value of every numeric sensor.", value,
+		"device", device, "sensor", sensor, "unit", unit)
+}
+
+func format(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// bucketLabels adds the le label to the labels of a histogram
+func bucketLabels(key, le string) string {
+	if key == "" {
+		return "{le=\"" + le + "\"}"
+	}
+	return key[:len(key)-1] + ",le=\"" + le + "\"}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Write writes every metric in the text format of Prometheus
+func Write(w io.Writer) {
+	mutex.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	mutex.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		mutex.Lock()
+		m := registry[name]
+		fn := m.fn
+		mutex.Unlock()
+		// the gauges read when scraped could take locks of their own
+		var value float64
+		if fn != nil {
+			value = fn()
+		}
+
+		mutex.Lock()
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		if fn != nil {
+			fmt.Fprintf(w, "%s %s\n", m.name, format(value))
+		}
+		for _, key := range sortedKeys(m.values) {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, key, format(m.values[key]))
+		}
+		hkeys := make([]string, 0, len(m.hists))
+		for key := range m.hists {
+			hkeys = append(hkeys, key)
+		}
+		sort.Strings(hkeys)
+		for _, key := range hkeys {
+			h := m.hists[key]
+			for k, le := range buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, bucketLabels(key, format(le)), h.counts[k])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, bucketLabels(key, "+Inf"), h.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", m.name, key, format(h.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", m.name, key, h.count)
+		}
+		mutex.Unlock()
+	}
+}
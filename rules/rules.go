@@ -0,0 +1,258 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/conejoninja/home/command"
+	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/storage"
+	"github.com/conejoninja/home/telegram"
+	"gopkg.in/yaml.v2"
+)
+
+var db storage.Storage
+var cfg common.HomeConfig
+
+// state of a rule: since when its condition holds and if it already fired
+type state struct {
+	rule  common.Rule
+	hold  time.Duration
+	since time.Time
+	fired bool
+}
+
+var rules []*state
+var mutex sync.Mutex
+
+// Start is the entrypoint of the rules engine
+func Start(homecfg common.HomeConfig, dbcon storage.Storage) {
+	cfg = homecfg
+	db = dbcon
+
+	if err := Load(cfg.RulesFile); err != nil {
+		fmt.Println("Error loading rules:", err)
+	}
+}
+
+// Load reads the rules from a YAML file, replacing the current ones
+func Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var list []common.Rule
+	if err = yaml.Unmarshal(data, &list); err != nil {
+		return err
+	}
+
+	loaded := make([]*state, 0, len(list))
+	for _, rule := range list {
+		if rule.Name == "" || rule.Device == "" || rule.Method == "" {
+			return fmt.Errorf("rule %q needs a name, a device and a method", rule.Name)
+		}
+		if rule.Sensor == "" && rule.Event == "" {
+			return fmt.Errorf("rule %q needs a sensor or an event", rule.Name)
+		}
+		for _, t := range []string{rule.From, rule.To} {
+			if t == "" {
+				continue
+			}
+			if _, err = time.Parse("15:04", t); err != nil {
+				return fmt.Errorf("rule %q: %q is not a time like 15:04", rule.Name, t)
+			}
+		}
+		// yaml decodes the nested maps with interface{} keys, which can't be sent as JSON
+		for k, v := range rule.Params {
+			rule.Params[k] = stringKeys(v)
+		}
+		s := &state{rule: rule}
+		if rule.For != "" {
+			if s.hold, err = time.ParseDuration(rule.For); err != nil {
+				return fmt.Errorf("rule %q: %s", rule.Name, err)
+			}
+		}
+		loaded = append(loaded, s)
+	}
+
+	mutex.Lock()
+	rules = loaded
+	mutex.Unlock()
+	return nil
+}
+
+// stringKeys converts the maps decoded by yaml, and the ones nested in them, to maps with string keys
+func stringKeys(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			m[fmt.Sprint(k)] = stringKeys(item)
+		}
+		return m
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = stringKeys(item)
+		}
+		return val
+	case []interface{}:
+		for k, item := range val {
+			val[k] = stringKeys(item)
+		}
+		return val
+	}
+	return v
+}
+
+// List returns all the rules
+func List() []common.Rule {
+	mutex.Lock()
+	defer mutex.Unlock()
+	list := make([]common.Rule, len(rules))
+	for k, s := range rules {
+		list[k] = s.rule
+	}
+	return list
+}
+
+// SetEnabled enables or disables a rule given its name
+func SetEnabled(name string, enabled bool) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, s := range rules {
+		if s.rule.Name == name {
+			s.rule.Enabled = enabled
+			s.since = time.Time{}
+			s.fired = false
+			return nil
+		}
+	}
+	return errors.New("Rule not found")
+}
+
+// ProcessValue evaluates the rules of a sensor ("<device>-<value id>") with a new value
+func ProcessValue(sensor string, value common.Value, datetime time.Time) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, s := range rules {
+		if !s.rule.Enabled || s.rule.Sensor != sensor {
+			continue
+		}
+		if !compare(value.Value, s.rule.Operator, s.rule.Value) {
+			s.since = time.Time{}
+			s.fired = false
+			continue
+		}
+		if s.since.IsZero() {
+			s.since = datetime
+		}
+		if !s.fired && datetime.Sub(s.since) >= s.hold && inWindow(s.rule, datetime) {
+			s.fired = true
+			go fire(s.rule)
+		}
+	}
+}
+
+// ProcessEvent evaluates the rules of an event, if the rule has a value it's compared to the event priority
+func ProcessEvent(evt common.Event) {
+	datetime := time.Now()
+	if evt.Time != nil && !evt.Time.IsZero() {
+		datetime = *evt.Time
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, s := range rules {
+		if !s.rule.Enabled || s.rule.Event != evt.ID {
+			continue
+		}
+		if s.rule.Value != "" && !compare(evt.Priority, s.rule.Operator, s.rule.Value) {
+			continue
+		}
+		if inWindow(s.rule, datetime) {
+			go fire(s.rule)
+		}
+	}
+}
+
+// compare a value with the one of the rule, numerically if both are numbers
+func compare(value interface{}, operator string, ruleValue string) bool {
+	val, err := common.GetFloat(value)
+	ref, errRef := strconv.ParseFloat(ruleValue, 64)
+	if err != nil || errRef != nil {
+		switch operator {
+		case "!=":
+			return fmt.Sprint(value) != ruleValue
+		case "==", "=", "":
+			return fmt.Sprint(value) == ruleValue
+		}
+		return false
+	}
+	switch operator {
+	case "<":
+		return val < ref
+	case "<=":
+		return val <= ref
+	case ">":
+		return val > ref
+	case ">=":
+		return val >= ref
+	case "!=":
+		return val != ref
+	case "==", "=", "":
+		return val == ref
+	}
+	return false
+}
+
+// inWindow checks if a time is between the From and To of the rule, the window could wrap midnight
+func inWindow(rule common.Rule, datetime time.Time) bool {
+	if rule.From == "" && rule.To == "" {
+		return true
+	}
+	datetime = datetime.In(cfg.Location)
+	now := datetime.Hour()*60 + datetime.Minute()
+	from, to := 0, 24*60
+	if t, err := time.Parse("15:04", rule.From); err == nil {
+		from = t.Hour()*60 + t.Minute()
+	}
+	if t, err := time.Parse("15:04", rule.To); err == nil {
+		to = t.Hour()*60 + t.Minute()
+	}
+	if from <= to {
+		return now >= from && now < to
+	}
+	return now >= from || now < to
+}
+
+// fire calls the method of the rule and records it as an event
+func fire(rule common.Rule) {
+	method := common.Method{Name: rule.Method}
+	keys := make([]string, 0, len(rule.Params))
+	for k := range rule.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		method.Params = append(method.Params, common.Value{ID: k, Value: rule.Params[k]})
+	}
+
+	err := command.Call(rule.Device, method)
+
+	now := time.Now()
+	evt := common.Event{
+		ID:      "rule-" + rule.Name,
+		Message: "Rule " + rule.Name + " called " + rule.Method + " on " + rule.Device,
+		Time:    &now,
+	}
+	if err != nil {
+		evt.Priority = 2
+		evt.Message = "Rule " + rule.Name + " failed to call " + rule.Method + " on " + rule.Device + ": " + err.Error()
+		telegram.NotifyEvent(evt)
+	}
+	db.AddEvent(evt.ID, evt)
+}
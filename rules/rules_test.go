@@ -0,0 +1,86 @@
+package rules
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestStringKeys(t *testing.T) {
+	params := map[interface{}]interface{}{
+		"color": map[interface{}]interface{}{"r": 255, 1: "one"},
+		"steps": []interface{}{map[interface{}]interface{}{"level": 10}},
+	}
+	converted := stringKeys(params)
+	if _, err := json.Marshal(converted); err != nil {
+		t.Fatal(err)
+	}
+	m, ok := converted.(map[string]interface{})
+	if !ok {
+		t.Fatalf("%T", converted)
+	}
+	color, ok := m["color"].(map[string]interface{})
+	if !ok || color["r"] != 255 || color["1"] != "one" {
+		t.Errorf("color %v", m["color"])
+	}
+	steps, ok := m["steps"].([]interface{})
+	if !ok || len(steps) != 1 {
+		t.Fatalf("steps %v", m["steps"])
+	}
+	if step, ok := steps[0].(map[string]interface{}); !ok || step["level"] != 10 {
+		t.Errorf("step %v", steps[0])
+	}
+}
+
+func load(t *testing.T, yaml string) error {
+	f, err := ioutil.TempFile("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(yaml)
+	f.Close()
+	return Load(f.Name())
+}
+
+func TestLoad(t *testing.T) {
+	err := load(t, `
+- name: heating
+  enabled: true
+  sensor: living-temperature
+  operator: "<"
+  value: "19"
+  from: "07:00"
+  to: "23:00"
+  device: heater
+  method: set
+  params:
+    mode: {target: 21, fan: auto}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := List()
+	if len(list) != 1 {
+		t.Fatalf("%d rules", len(list))
+	}
+	if _, err = json.Marshal(list[0].Params); err != nil {
+		t.Errorf("params can't be sent: %s", err)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	rules := []string{
+		"- {name: a, sensor: s, device: d, method: m, from: \"25:00\"}",
+		"- {name: a, sensor: s, device: d, method: m, to: night}",
+		"- {name: a, sensor: s, device: d, method: m, for: soon}",
+		"- {name: a, device: d, method: m}",
+		"- {sensor: s, device: d, method: m}",
+	}
+	for _, rule := range rules {
+		if err := load(t, rule); err == nil {
+			t.Errorf("%s should be rejected", rule)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package scene
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/conejoninja/home/command"
+	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/storage"
+)
+
+var db storage.Storage
+
+// Start sets the storage the scenes are read from
+func Start(dbcon storage.Storage) {
+	db = dbcon
+}
+
+// Validate checks every step of the scene could be run
+func Validate(scene common.Scene) error {
+	if scene.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(scene.Steps) == 0 {
+		return errors.New("a scene needs at least one step")
+	}
+	for k, step := range scene.Steps {
+		if step.Device == "" || step.Method.Name == "" {
+			return fmt.Errorf("step %d: device and method are required", k)
+		}
+		if step.Delay != "" {
+			if _, err := time.ParseDuration(step.Delay); err != nil {
+				return fmt.Errorf("step %d: %s", k, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Activate runs every step of a scene, a failed call doesn't stop the next ones. The steps before
+// the first delay are run right away, the rest are run in the background and marked as pending.
+// It returns the result of each call, and an error if any of them failed
+func Activate(name string) ([]common.CallResult, error) {
+	scene := db.GetScene([]byte(name))
+	if scene.Name == "" {
+		return nil, errors.New("Scene not found")
+	}
+
+	results := make([]common.CallResult, len(scene.Steps))
+	first := len(scene.Steps)
+	for k, step := range scene.Steps {
+		results[k].Device = step.Device
+		results[k].Method = step.Method.Name
+		if delay, err := time.ParseDuration(step.Delay); err == nil && delay > 0 && first == len(scene.Steps) {
+			first = k
+		}
+	}
+
+	failed := run(scene.Steps[:first], results[:first])
+	if first == len(scene.Steps) {
+		return results, finish(name, failed, len(results))
+	}
+
+	delayed := make([]common.CallResult, len(results)-first)
+	copy(delayed, results[first:])
+	for k := first; k < len(results); k++ {
+		results[k].Pending = true
+	}
+	go func(failed int) {
+		failed += run(scene.Steps[first:], delayed)
+		finish(name, failed, len(results))
+	}(failed)
+
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d calls failed", failed, len(results))
+	}
+	return results, nil
+}
+
+// run calls the steps in order, waiting their delay, and returns how many of them failed
+func run(steps []common.SceneStep, results []common.CallResult) int {
+	failed := 0
+	for k, step := range steps {
+		if delay, err := time.ParseDuration(step.Delay); err == nil {
+			time.Sleep(delay)
+		}
+		if err := command.Call(step.Device, step.Method); err != nil {
+			results[k].Error = err.Error()
+			failed++
+		}
+	}
+	return failed
+}
+
+// finish records the activation of a scene once all its steps were run
+func finish(name string, failed, total int) error {
+	now := time.Now()
+	evt := common.Event{
+		ID:      "scene-" + name,
+		Message: "Scene " + name + " activated",
+		Time:    &now,
+	}
+	var err error
+	if failed > 0 {
+		err = fmt.Errorf("%d of %d calls failed", failed, total)
+		evt.Priority = 2
+		evt.Message = "Scene " + name + " activated, " + err.Error()
+	}
+	db.AddEvent(evt.ID, evt)
+	return err
+}
@@ -0,0 +1,135 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/conejoninja/home/command"
+	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/storage"
+	"github.com/conejoninja/home/telegram"
+	"github.com/robfig/cron"
+)
+
+var db storage.Storage
+var cfg common.HomeConfig
+
+// schedules being run, so stopping waits for them
+var running sync.WaitGroup
+var stop = make(chan struct{})
+var stopped = make(chan struct{})
+
+// Start is the entrypoint of the scheduler, schedules are checked every minute
+func Start(homecfg common.HomeConfig, dbcon storage.Storage) {
+	cfg = homecfg
+	db = dbcon
+
+	go func() {
+		defer close(stopped)
+		last := time.Now()
+		for {
+			now := time.Now()
+			select {
+			case <-stop:
+				return
+			case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+			}
+			now = time.Now()
+			for _, schedule := range db.GetSchedules() {
+				if !schedule.Enabled {
+					continue
+				}
+				next, err := Next(schedule, last)
+				if err != nil {
+					fmt.Println("Schedule", schedule.ID, err)
+					continue
+				}
+				if !next.IsZero() && !next.After(now) {
+					running.Add(1)
+					go func(schedule common.Schedule, now time.Time) {
+						defer running.Done()
+						run(schedule, now)
+					}(schedule, now)
+				}
+			}
+			last = now
+		}
+	}()
+}
+
+// Stop stops checking the schedules, and waits for the ones being run
+func Stop() {
+	close(stop)
+	<-stopped
+	running.Wait()
+}
+
+// Validate checks the schedule could be run
+func Validate(schedule common.Schedule) error {
+	if schedule.ID == "" || schedule.Device == "" || schedule.Method.Name == "" {
+		return errors.New("id, device and method are required")
+	}
+	if (schedule.Cron == "") == (schedule.Sun == "") {
+		return errors.New("either cron or sun is required")
+	}
+	_, err := Next(schedule, time.Now())
+	return err
+}
+
+// Next returns the next time after the given one the schedule should be run
+func Next(schedule common.Schedule, after time.Time) (time.Time, error) {
+	after = after.In(cfg.Location)
+	if schedule.Cron != "" {
+		expr, err := cron.ParseStandard(schedule.Cron)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return expr.Next(after), nil
+	}
+
+	if schedule.Sun != "sunrise" && schedule.Sun != "sunset" {
+		return time.Time{}, errors.New("sun should be sunrise or sunset")
+	}
+	var offset time.Duration
+	if schedule.Offset != "" {
+		var err error
+		if offset, err = time.ParseDuration(schedule.Offset); err != nil {
+			return time.Time{}, err
+		}
+	}
+	// Look a few days ahead, near the poles the sun could not rise or set for a while
+	day := time.Date(after.Year(), after.Month(), after.Day(), 0, 0, 0, 0, cfg.Location)
+	for i := 0; i < 7; i++ {
+		t, ok := sunTime(day.AddDate(0, 0, i), cfg.Latitude, cfg.Longitude, schedule.Sun == "sunrise")
+		if ok && t.Add(offset).After(after) {
+			return t.Add(offset), nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// run calls the method of the schedule and records the execution as an event
+func run(schedule common.Schedule, now time.Time) {
+	err := command.Call(schedule.Device, schedule.Method)
+
+	evt := common.Event{
+		ID:      "schedule-" + schedule.ID,
+		Message: "Schedule " + schedule.ID + " called " + schedule.Method.Name + " on " + schedule.Device,
+		Time:    &now,
+	}
+	if err != nil {
+		evt.Priority = 2
+		evt.Message = "Schedule " + schedule.ID + " failed to call " + schedule.Method.Name + " on " + schedule.Device + ": " + err.Error()
+		telegram.NotifyEvent(evt)
+	}
+	db.AddEvent(evt.ID, evt)
+
+	// The schedule could have been modified meanwhile
+	current := db.GetSchedule([]byte(schedule.ID))
+	if current.ID == schedule.ID {
+		current.LastRun = &now
+		db.AddSchedule([]byte(current.ID), current)
+	}
+}
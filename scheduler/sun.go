@@ -0,0 +1,74 @@
+package scheduler
+
+import (
+	"math"
+	"time"
+)
+
+const zenith = 90.833
+
+func deg2rad(d float64) float64 {
+	return d * math.Pi / 180
+}
+
+func rad2deg(r float64) float64 {
+	return r * 180 / math.Pi
+}
+
+// normalize a value to the [0, max) range
+func normalize(v, max float64) float64 {
+	v = math.Mod(v, max)
+	if v < 0 {
+		v += max
+	}
+	return v
+}
+
+// sunTime returns the sunrise (or sunset) of the given day at the given coordinates, computed
+// with the algorithm of the Almanac for Computers. ok is false if the sun doesn't rise (or set) that day
+func sunTime(day time.Time, latitude, longitude float64, rising bool) (t time.Time, ok bool) {
+	lngHour := longitude / 15
+	approx := float64(day.YearDay())
+	if rising {
+		approx += (6 - lngHour) / 24
+	} else {
+		approx += (18 - lngHour) / 24
+	}
+
+	anomaly := (0.9856 * approx) - 3.289
+	trueLng := normalize(anomaly+(1.916*math.Sin(deg2rad(anomaly)))+(0.020*math.Sin(deg2rad(2*anomaly)))+282.634, 360)
+
+	ra := normalize(rad2deg(math.Atan(0.91764*math.Tan(deg2rad(trueLng)))), 360)
+	ra += math.Floor(trueLng/90)*90 - math.Floor(ra/90)*90
+	ra /= 15
+
+	sinDec := 0.39782 * math.Sin(deg2rad(trueLng))
+	cosDec := math.Cos(math.Asin(sinDec))
+	cosH := (math.Cos(deg2rad(zenith)) - (sinDec * math.Sin(deg2rad(latitude)))) / (cosDec * math.Cos(deg2rad(latitude)))
+	if cosH > 1 || cosH < -1 {
+		return t, false
+	}
+
+	var hour float64
+	if rising {
+		hour = 360 - rad2deg(math.Acos(cosH))
+	} else {
+		hour = rad2deg(math.Acos(cosH))
+	}
+	hour /= 15
+
+	local := hour + ra - (0.06571 * approx) - 6.622
+	ut := normalize(local-lngHour, 24)
+
+	t = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC).Add(time.Duration(ut * float64(time.Hour)))
+	// UT could fall on the previous or next day of the local date
+	localT := t.In(day.Location())
+	if localT.YearDay() != day.YearDay() {
+		if localT.Before(day) {
+			t = t.Add(24 * time.Hour)
+		} else {
+			t = t.Add(-24 * time.Hour)
+		}
+	}
+	return t.In(day.Location()), true
+}
@@ -0,0 +1,286 @@
+package shadow
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/conejoninja/home/command"
+	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/storage"
+)
+
+// Method is the name of the method the delta is sent with, its params are the desired values
+const Method = "shadow"
+
+var db storage.Storage
+var cfg common.HomeConfig
+
+// devices with a shadow, so the values of the rest are not looked at
+var shadowed = make(map[string]bool)
+var mutex sync.Mutex
+
+var stop = make(chan struct{})
+var stopped = make(chan struct{})
+
+// Start loads the shadows and keeps sending their delta until the devices report it
+func Start(homecfg common.HomeConfig, dbcon storage.Storage) {
+	cfg = homecfg
+	db = dbcon
+
+	mutex.Lock()
+	for _, s := range db.GetShadows() {
+		shadowed[s.Device] = true
+	}
+	mutex.Unlock()
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(cfg.ShadowRetry)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				retry()
+			}
+		}
+	}()
+}
+
+// Stop stops sending the delta of the shadows, waiting for the retry in progress
+func Stop() {
+	close(stop)
+	<-stopped
+}
+
+// Get returns the shadow of a device with its delta
+func Get(device string) common.Shadow {
+	mutex.Lock()
+	defer mutex.Unlock()
+	s := db.GetShadow(device)
+	if s.Device == "" {
+		s = newShadow(device)
+	}
+	s.Delta = delta(s)
+	return s
+}
+
+// Validate checks the device could receive its desired state, it needs the shadow method and every
+// desired value has to be one of its values. Removing a value is always possible
+func Validate(device common.Device, desired map[string]interface{}) error {
+	found := false
+	for _, method := range device.Methods {
+		if method.Name == Method {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s doesn't have the %s method", device.ID, Method)
+	}
+	keys := make([]string, 0, len(desired))
+	for k := range desired {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if desired[k] == nil {
+			continue
+		}
+		known := false
+		for _, out := range device.Out {
+			if out.ID == k {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("%s is not a value of %s", k, device.ID)
+		}
+	}
+	return nil
+}
+
+// Patch merges the desired state of a device, a nil value removes it from the desired state.
+// The delta is sent to the device right away
+func Patch(device string, desired map[string]interface{}) (common.Shadow, error) {
+	if device == "" {
+		return common.Shadow{}, errors.New("device is required")
+	}
+	d := db.GetDevice([]byte(device))
+	if d.IsNil() {
+		return common.Shadow{}, errors.New("Device not found")
+	}
+	if err := Validate(d, desired); err != nil {
+		return common.Shadow{}, err
+	}
+
+	mutex.Lock()
+	s := db.GetShadow(device)
+	if s.Device == "" {
+		s = newShadow(device)
+	}
+	for k, v := range desired {
+		if v == nil {
+			delete(s.Desired, k)
+		} else {
+			s.Desired[k] = v
+		}
+	}
+	now := time.Now()
+	s.Version++
+	s.Updated = &now
+	s.Delta = delta(s)
+	// a new desired state gets all the attempts again
+	s.Attempts = 0
+	s.Error = ""
+	err := db.AddShadow(device, s)
+	shadowed[device] = true
+	mutex.Unlock()
+	if err != nil {
+		return s, err
+	}
+
+	if len(s.Delta) > 0 {
+		return push(s), nil
+	}
+	return s, nil
+}
+
+// Report updates the reported state of a device with one of its values
+func Report(device string, value common.Value) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !shadowed[device] || value.Value == nil {
+		return
+	}
+	s := db.GetShadow(device)
+	if equal(s.Reported[value.ID], value.Value) {
+		return
+	}
+	if s.Reported == nil {
+		s.Reported = make(map[string]interface{})
+	}
+	s.Reported[value.ID] = value.Value
+	s.Delta = delta(s)
+	if len(s.Delta) == 0 {
+		s.Attempts = 0
+		s.Error = ""
+	}
+	db.AddShadow(device, s)
+}
+
+// newShadow returns an empty shadow, with the last values of the device as reported state
+func newShadow(device string) common.Shadow {
+	s := common.Shadow{
+		Device:   device,
+		Desired:  make(map[string]interface{}),
+		Reported: make(map[string]interface{}),
+	}
+	for _, out := range db.GetDevice([]byte(device)).Out {
+		if last := db.GetLastValue(device + "-" + out.ID); last.Value != nil {
+			s.Reported[out.ID] = last.Value
+		}
+	}
+	return s
+}
+
+// delta returns the desired values that are not reported
+func delta(s common.Shadow) map[string]interface{} {
+	d := make(map[string]interface{})
+	for k, v := range s.Desired {
+		if !equal(v, s.Reported[k]) {
+			d[k] = v
+		}
+	}
+	return d
+}
+
+// equal compares two values, numbers are compared as numbers even if one of them is a string
+func equal(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if fa, err := number(a); err == nil {
+		if fb, err := number(b); err == nil {
+			return fa == fb
+		}
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func number(v interface{}) (float64, error) {
+	switch val := v.(type) {
+	case string:
+		return strconv.ParseFloat(val, 64)
+	case bool:
+		return 0, errors.New("not a number")
+	}
+	return common.GetFloat(v)
+}
+
+// push sends the delta of a shadow to its device
+func push(s common.Shadow) common.Shadow {
+	keys := make([]string, 0, len(s.Delta))
+	for k := range s.Delta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	method := common.Method{Name: Method, Params: make([]common.Value, 0, len(keys))}
+	for _, k := range keys {
+		method.Params = append(method.Params, common.Value{ID: k, Value: s.Delta[k]})
+	}
+
+	call, err := command.Send(s.Device, method, cfg.ShadowRetry)
+	if err != nil {
+		fmt.Println("Shadow of", s.Device, err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	stored := db.GetShadow(s.Device)
+	stored.LastCall = call.ID
+	stored.Attempts++
+	stored.Delta = delta(stored)
+	db.AddShadow(s.Device, stored)
+	return stored
+}
+
+// retry sends again the delta of the shadows that didn't converge, unless the last call is still
+// waiting for the device. It gives up once every attempt was made
+func retry() {
+	mutex.Lock()
+	var pending []common.Shadow
+	for _, s := range db.GetShadows() {
+		s.Delta = delta(s)
+		if len(s.Delta) == 0 || s.Error != "" {
+			continue
+		}
+		if s.LastCall != "" {
+			last := db.GetCall(s.Device, s.LastCall)
+			if last.Status == "queued" {
+				continue
+			}
+			if last.Status == "pending" && last.Sent != nil && time.Since(*last.Sent) < cfg.ShadowRetry {
+				continue
+			}
+		}
+		if s.Attempts >= cfg.ShadowAttempts {
+			s.Error = fmt.Sprintf("gave up after %d attempts", s.Attempts)
+			fmt.Println("Shadow of", s.Device, s.Error)
+			db.AddShadow(s.Device, s)
+			continue
+		}
+		pending = append(pending, s)
+	}
+	mutex.Unlock()
+
+	for _, s := range pending {
+		push(s)
+	}
+}
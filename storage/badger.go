@@ -4,11 +4,13 @@ import (
 	"log"
 
 	"os"
+	"path/filepath"
 
 	"encoding/json"
 
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"fmt"
@@ -19,14 +21,30 @@ import (
 
 //Badger type
 type Badger struct {
-	valuesPath  string
-	devicesPath string
-	metaPath    string
-	eventsPath  string
-	valuesKV    *badger.KV
-	devicesKV   *badger.KV
-	metaKV      *badger.KV
-	eventsKV    *badger.KV
+	valuesPath     string
+	devicesPath    string
+	metaPath       string
+	eventsPath     string
+	schedulesPath  string
+	scenesPath     string
+	quarantinePath string
+	callsPath      string
+	queuePath      string
+	shadowsPath    string
+	deadPath       string
+	valuesKV       *badger.KV
+	devicesKV      *badger.KV
+	metaKV         *badger.KV
+	eventsKV       *badger.KV
+	schedulesKV    *badger.KV
+	scenesKV       *badger.KV
+	quarantineKV   *badger.KV
+	callsKV        *badger.KV
+	queueKV        *badger.KV
+	shadowsKV      *badger.KV
+	deadKV         *badger.KV
+	closed         bool
+	closedMutex    sync.Mutex
 }
 
 // NewBadger opens and returns a storage
@@ -50,6 +68,27 @@ func NewBadger(path string) *Badger {
 	db.eventsPath = path + "events"
 	db.eventsKV = openKV(db.eventsPath)
 
+	db.schedulesPath = path + "schedules"
+	db.schedulesKV = openKV(db.schedulesPath)
+
+	db.scenesPath = path + "scenes"
+	db.scenesKV = openKV(db.scenesPath)
+
+	db.quarantinePath = path + "quarantine"
+	db.quarantineKV = openKV(db.quarantinePath)
+
+	db.callsPath = path + "calls"
+	db.callsKV = openKV(db.callsPath)
+
+	db.queuePath = path + "queue"
+	db.queueKV = openKV(db.queuePath)
+
+	db.shadowsPath = path + "shadows"
+	db.shadowsKV = openKV(db.shadowsPath)
+
+	db.deadPath = path + "deadletters"
+	db.deadKV = openKV(db.deadPath)
+
 	return &db
 }
 
@@ -70,9 +109,82 @@ func openKV(path string) *badger.KV {
 	return kv
 }
 
-// Close the storage
-func (db *Badger) Close() {
-	db.Close()
+// IsOpen checks the storage wasn't closed and still works, writing a key to the meta store and
+// reading it back
+func (db *Badger) IsOpen() bool {
+	db.closedMutex.Lock()
+	defer db.closedMutex.Unlock()
+	if db.closed {
+		return false
+	}
+
+	key := []byte("$healthcheck")
+	value := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := db.metaKV.Set(key, value); err != nil {
+		return false
+	}
+	var item badger.KVItem
+	if err := db.metaKV.Get(key, &item); err != nil {
+		return false
+	}
+	ok := string(item.Value()) == string(value)
+	db.metaKV.Delete(key)
+	return ok
+}
+
+// Size returns the size in bytes of the files of every KV store
+func (db *Badger) Size() int64 {
+	var size int64
+	for _, path := range []string{
+		db.valuesPath,
+		db.devicesPath,
+		db.metaPath,
+		db.eventsPath,
+		db.schedulesPath,
+		db.scenesPath,
+		db.quarantinePath,
+		db.callsPath,
+		db.queuePath,
+		db.shadowsPath,
+		db.deadPath,
+	} {
+		filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+	}
+	return size
+}
+
+// Close the storage, closing every KV store. It returns the first error found
+func (db *Badger) Close() error {
+	db.closedMutex.Lock()
+	defer db.closedMutex.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	var err error
+	for _, kv := range []*badger.KV{
+		db.valuesKV,
+		db.devicesKV,
+		db.metaKV,
+		db.eventsKV,
+		db.schedulesKV,
+		db.scenesKV,
+		db.quarantineKV,
+		db.callsKV,
+		db.queueKV,
+		db.shadowsKV,
+		db.deadKV,
+	} {
+		if e := kv.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
 // AddDevice adds a new device
@@ -197,6 +309,28 @@ func (db *Badger) GetLastValue(id string) common.Value {
 	return value
 }
 
+// GetLastValueBefore returns the last value of a sensor stored before a given date
+func (db *Badger) GetLastValueBefore(id string, before time.Time) common.Value {
+	var value common.Value
+	itrOpt := badger.IteratorOptions{
+		PrefetchSize: 1000,
+		FetchValues:  true,
+		Reverse:      true,
+	}
+	itr := db.valuesKV.NewIterator(itrOpt)
+	for itr.Seek([]byte(id + "-" + strconv.Itoa(int(before.Unix())-1))); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		if strings.HasPrefix(string(item.Key()), id+"-") {
+			err := json.Unmarshal(item.Value(), &value)
+			if err != nil {
+				// Do something ?
+			}
+		}
+		break
+	}
+	return value
+}
+
 // GetValuesBetweenTime returns all the values between two given dates
 func (db *Badger) GetValuesBetweenTime(id string, start, end time.Time) []common.Value {
 
@@ -393,6 +527,405 @@ func (db *Badger) AddMeta(id []byte, meta common.Meta) error {
 	return nil
 }
 
+// AddSchedule adds or replaces a schedule
+func (db *Badger) AddSchedule(id []byte, schedule common.Schedule) error {
+	payload, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+	return db.schedulesKV.Set(id, payload)
+}
+
+// GetSchedule returns a schedule given its ID
+func (db *Badger) GetSchedule(id []byte) common.Schedule {
+	var schedule common.Schedule
+	itrOpt := badger.IteratorOptions{
+		PrefetchSize: 1000,
+		FetchValues:  true,
+		Reverse:      false,
+	}
+	itr := db.schedulesKV.NewIterator(itrOpt)
+	for itr.Seek(id); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		if string(id) == string(item.Key()) {
+			err := json.Unmarshal(item.Value(), &schedule)
+			if err != nil {
+				// Do something ?
+			}
+			return schedule
+		}
+		break
+	}
+	return schedule
+}
+
+// GetSchedules returns all the schedules
+func (db *Badger) GetSchedules() []common.Schedule {
+	itrOpt := badger.IteratorOptions{
+		PrefetchSize: 1000,
+		FetchValues:  true,
+		Reverse:      false,
+	}
+	itr := db.schedulesKV.NewIterator(itrOpt)
+	schedules := make([]common.Schedule, 0)
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		var schedule common.Schedule
+		err := json.Unmarshal(item.Value(), &schedule)
+		if err != nil {
+			continue
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules
+}
+
+// DeleteSchedule removes a schedule
+func (db *Badger) DeleteSchedule(id []byte) error {
+	return db.schedulesKV.Delete(id)
+}
+
+// AddScene adds or replaces a scene
+func (db *Badger) AddScene(name []byte, scene common.Scene) error {
+	payload, err := json.Marshal(scene)
+	if err != nil {
+		return err
+	}
+	return db.scenesKV.Set(name, payload)
+}
+
+// GetScene returns a scene given its name
+func (db *Badger) GetScene(name []byte) common.Scene {
+	var scene common.Scene
+	itrOpt := badger.IteratorOptions{
+		PrefetchSize: 1000,
+		FetchValues:  true,
+		Reverse:      false,
+	}
+	itr := db.scenesKV.NewIterator(itrOpt)
+	for itr.Seek(name); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		if string(name) == string(item.Key()) {
+			err := json.Unmarshal(item.Value(), &scene)
+			if err != nil {
+				// Do something ?
+			}
+			return scene
+		}
+		break
+	}
+	return scene
+}
+
+// GetScenes returns all the scenes
+func (db *Badger) GetScenes() []common.Scene {
+	itrOpt := badger.IteratorOptions{
+		PrefetchSize: 1000,
+		FetchValues:  true,
+		Reverse:      false,
+	}
+	itr := db.scenesKV.NewIterator(itrOpt)
+	scenes := make([]common.Scene, 0)
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		var scene common.Scene
+		err := json.Unmarshal(item.Value(), &scene)
+		if err != nil {
+			continue
+		}
+		scenes = append(scenes, scene)
+	}
+	return scenes
+}
+
+// DeleteScene removes a scene
+func (db *Badger) DeleteScene(name []byte) error {
+	return db.scenesKV.Delete(name)
+}
+
+// AddQuarantined adds a rejected value of a device
+func (db *Badger) AddQuarantined(device string, q common.Quarantined) error {
+	if q.Time == nil || (*q.Time).IsZero() {
+		now := time.Now()
+		q.Time = &now
+	}
+
+	id := []byte(device + "-" + strconv.FormatInt(q.Time.UnixNano(), 10))
+
+	payload, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	return db.quarantineKV.Set(id, payload)
+}
+
+// GetLastQuarantined returns a given number of most recent rejected values of a device
+func (db *Badger) GetLastQuarantined(device string, count int) []common.Quarantined {
+	values := make([]common.Quarantined, 0, count)
+	itrOpt := badger.IteratorOptions{
+		PrefetchSize: 1000,
+		FetchValues:  true,
+		Reverse:      true,
+	}
+	itr := db.quarantineKV.NewIterator(itrOpt)
+	for itr.Seek([]byte(device + "-9")); itr.Valid() && len(values) < count; itr.Next() {
+		item := itr.Item()
+		if !strings.HasPrefix(string(item.Key()), device+"-") {
+			break
+		}
+		var q common.Quarantined
+		err := json.Unmarshal(item.Value(), &q)
+		// the prefix matches devices like <device>-kitchen too
+		if err != nil || q.Device != device {
+			continue
+		}
+		values = append(values, q)
+	}
+	return values
+}
+
+// AddCall adds or updates a method call to a device, the ID of the call is its time in nanoseconds
+func (db *Badger) AddCall(call common.Call) error {
+	payload, err := json.Marshal(call)
+	if err != nil {
+		return err
+	}
+	return db.callsKV.Set([]byte(call.Device+"-"+call.ID), payload)
+}
+
+// GetCall returns a method call to a device given its ID
+func (db *Badger) GetCall(device, id string) common.Call {
+	var call common.Call
+	key := device + "-" + id
+	itrOpt := badger.IteratorOptions{
+		PrefetchSize: 1000,
+		FetchValues:  true,
+		Reverse:      false,
+	}
+	itr := db.callsKV.NewIterator(itrOpt)
+	for itr.Seek([]byte(key)); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		if key == string(item.Key()) {
+			json.Unmarshal(item.Value(), &call)
+		}
+		break
+	}
+	return call
+}
+
+// GetLastCalls returns a given number of most recent method calls to a device
+func (db *Badger) GetLastCalls(device string, count int) []common.Call {
+	calls := make([]common.Call, 0, count)
+	itrOpt := badger.IteratorOptions{
+		PrefetchSize: 1000,
+		FetchValues:  true,
+		Reverse:      true,
+	}
+	itr := db.callsKV.NewIterator(itrOpt)
+	for itr.Seek([]byte(device + "-9")); itr.Valid() && len(calls) < count; itr.Next() {
+		item := itr.Item()
+		if !strings.HasPrefix(string(item.Key()), device+"-") {
+			break
+		}
+		var call common.Call
+		err := json.Unmarshal(item.Value(), &call)
+		// the prefix matches devices like <device>-kitchen too
+		if err != nil || call.Device != device {
+			continue
+		}
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// AddQueued adds a call to the queue of its device
+func (db *Badger) AddQueued(call common.Call) error {
+	payload, err := json.Marshal(call)
+	if err != nil {
+		return err
+	}
+	return db.queueKV.Set([]byte(call.Device+"-"+call.ID), payload)
+}
+
+// GetQueued returns the queued calls of a device, oldest first
+func (db *Badger) GetQueued(device string) []common.Call {
+	var calls []common.Call
+	itrOpt := badger.IteratorOptions{
+		PrefetchSize: 1000,
+		FetchValues:  true,
+		Reverse:      false,
+	}
+	itr := db.queueKV.NewIterator(itrOpt)
+	for itr.Seek([]byte(device + "-")); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		if !strings.HasPrefix(string(item.Key()), device+"-") {
+			break
+		}
+		var call common.Call
+		err := json.Unmarshal(item.Value(), &call)
+		if err != nil || call.Device != device {
+			continue
+		}
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// GetAllQueued returns the queued calls of every device
+func (db *Badger) GetAllQueued() []common.Call {
+	var calls []common.Call
+	itrOpt := badger.IteratorOptions{
+		PrefetchSize: 1000,
+		FetchValues:  true,
+		Reverse:      false,
+	}
+	itr := db.queueKV.NewIterator(itrOpt)
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		var call common.Call
+		err := json.Unmarshal(itr.Item().Value(), &call)
+		if err != nil {
+			continue
+		}
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// DeleteQueued removes a call from the queue of its device
+func (db *Badger) DeleteQueued(device, id string) error {
+	return db.queueKV.Delete([]byte(device + "-" + id))
+}
+
+// AddShadow adds or updates the shadow of a device
+func (db *Badger) AddShadow(device string, shadow common.Shadow) error {
+	payload, err := json.Marshal(shadow)
+	if err != nil {
+		return err
+	}
+	return db.shadowsKV.Set([]byte(device), payload)
+}
+
+// GetShadow returns the shadow of a device
+func (db *Badger) GetShadow(device string) common.Shadow {
+	var shadow common.Shadow
+	itrOpt := badger.IteratorOptions{
+		PrefetchSize: 1000,
+		FetchValues:  true,
+		Reverse:      false,
+	}
+	itr := db.shadowsKV.NewIterator(itrOpt)
+	for itr.Seek([]byte(device)); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		if device == string(item.Key()) {
+			json.Unmarshal(item.Value(), &shadow)
+		}
+		break
+	}
+	return shadow
+}
+
+// GetShadows returns the shadows of every device
+func (db *Badger) GetShadows() []common.Shadow {
+	itrOpt := badger.IteratorOptions{
+		PrefetchSize: 1000,
+		FetchValues:  true,
+		Reverse:      false,
+	}
+	itr := db.shadowsKV.NewIterator(itrOpt)
+	shadows := make([]common.Shadow, 0)
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		var shadow common.Shadow
+		err := json.Unmarshal(itr.Item().Value(), &shadow)
+		if err != nil {
+			continue
+		}
+		shadows = append(shadows, shadow)
+	}
+	return shadows
+}
+
+// AddDeadLetter adds a message that couldn't be parsed, only the max most recent ones are kept
+func (db *Badger) AddDeadLetter(dl common.DeadLetter, max int) error {
+	if dl.Time == nil || (*dl.Time).IsZero() {
+		now := time.Now()
+		dl.Time = &now
+	}
+	dl.ID = strconv.FormatInt(dl.Time.UnixNano(), 10)
+
+	payload, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	if err = db.deadKV.Set([]byte(dl.ID), payload); err != nil {
+		return err
+	}
+
+	itrOpt := badger.IteratorOptions{
+		PrefetchSize: 1000,
+		FetchValues:  false,
+		Reverse:      true,
+	}
+	itr := db.deadKV.NewIterator(itrOpt)
+	var old [][]byte
+	count := 0
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		count++
+		if count > max {
+			key := make([]byte, len(itr.Item().Key()))
+			copy(key, itr.Item().Key())
+			old = append(old, key)
+		}
+	}
+	for _, key := range old {
+		db.deadKV.Delete(key)
+	}
+	return nil
+}
+
+// GetDeadLetter returns a message that couldn't be parsed given its ID
+func (db *Badger) GetDeadLetter(id string) common.DeadLetter {
+	var dl common.DeadLetter
+	itrOpt := badger.IteratorOptions{
+		PrefetchSize: 1000,
+		FetchValues:  true,
+		Reverse:      false,
+	}
+	itr := db.deadKV.NewIterator(itrOpt)
+	for itr.Seek([]byte(id)); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		if id == string(item.Key()) {
+			json.Unmarshal(item.Value(), &dl)
+		}
+		break
+	}
+	return dl
+}
+
+// GetLastDeadLetters returns a given number of most recent messages that couldn't be parsed
+func (db *Badger) GetLastDeadLetters(count int) []common.DeadLetter {
+	dls := make([]common.DeadLetter, 0, count)
+	itrOpt := badger.IteratorOptions{
+		PrefetchSize: 1000,
+		FetchValues:  true,
+		Reverse:      true,
+	}
+	itr := db.deadKV.NewIterator(itrOpt)
+	for itr.Rewind(); itr.Valid() && len(dls) < count; itr.Next() {
+		var dl common.DeadLetter
+		err := json.Unmarshal(itr.Item().Value(), &dl)
+		if err != nil {
+			continue
+		}
+		dls = append(dls, dl)
+	}
+	return dls
+}
+
+// DeleteDeadLetter removes a message that couldn't be parsed
+func (db *Badger) DeleteDeadLetter(id string) error {
+	return db.deadKV.Delete([]byte(id))
+}
+
 // ListAll lists all the pairs KV of a given type
 func (db *Badger) ListAll(what string) {
 
@@ -409,6 +942,20 @@ func (db *Badger) ListAll(what string) {
 		itr = db.devicesKV.NewIterator(itrOpt)
 	} else if what == "events" {
 		itr = db.eventsKV.NewIterator(itrOpt)
+	} else if what == "schedules" {
+		itr = db.schedulesKV.NewIterator(itrOpt)
+	} else if what == "scenes" {
+		itr = db.scenesKV.NewIterator(itrOpt)
+	} else if what == "quarantine" {
+		itr = db.quarantineKV.NewIterator(itrOpt)
+	} else if what == "calls" {
+		itr = db.callsKV.NewIterator(itrOpt)
+	} else if what == "queue" {
+		itr = db.queueKV.NewIterator(itrOpt)
+	} else if what == "shadows" {
+		itr = db.shadowsKV.NewIterator(itrOpt)
+	} else if what == "deadletters" {
+		itr = db.deadKV.NewIterator(itrOpt)
 	} else {
 		itr = db.valuesKV.NewIterator(itrOpt)
 	}
@@ -13,6 +13,7 @@ type Storage interface {
 	AddMeta(id []byte, meta common.Meta) error
 	GetValue(id []byte) common.Value
 	GetLastValue(id string) common.Value
+	GetLastValueBefore(id string, before time.Time) common.Value
 	GetEvent(id []byte) common.Event
 	GetMeta(id []byte) common.Meta
 	GetValuesBetweenTime(id string, start, end time.Time) []common.Value
@@ -20,4 +21,31 @@ type Storage interface {
 	GetDevice(id []byte) common.Device
 	GetDevices() []common.Device
 	GetLastEvents(id string, count int) []common.Event
+	AddSchedule(id []byte, schedule common.Schedule) error
+	GetSchedule(id []byte) common.Schedule
+	GetSchedules() []common.Schedule
+	DeleteSchedule(id []byte) error
+	AddScene(name []byte, scene common.Scene) error
+	GetScene(name []byte) common.Scene
+	GetScenes() []common.Scene
+	DeleteScene(name []byte) error
+	AddQuarantined(device string, q common.Quarantined) error
+	GetLastQuarantined(device string, count int) []common.Quarantined
+	AddCall(call common.Call) error
+	GetCall(device, id string) common.Call
+	GetLastCalls(device string, count int) []common.Call
+	AddQueued(call common.Call) error
+	GetQueued(device string) []common.Call
+	GetAllQueued() []common.Call
+	DeleteQueued(device, id string) error
+	AddShadow(device string, shadow common.Shadow) error
+	GetShadow(device string) common.Shadow
+	GetShadows() []common.Shadow
+	AddDeadLetter(dl common.DeadLetter, max int) error
+	GetDeadLetter(id string) common.DeadLetter
+	GetLastDeadLetters(count int) []common.DeadLetter
+	DeleteDeadLetter(id string) error
+	IsOpen() bool
+	Size() int64
+	Close() error
 }
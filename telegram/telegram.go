@@ -2,8 +2,10 @@ package telegram
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/conejoninja/home/common"
+	"github.com/conejoninja/home/scene"
 	"gopkg.in/telegram-bot-api.v4"
 )
 
@@ -23,6 +25,84 @@ func Start(homecfg common.HomeConfig) {
 		connected = true
 	}
 	bot.Debug = false
+
+	if connected {
+		go listen()
+	}
+}
+
+// Connected checks the bot could log in to Telegram
+func Connected() bool {
+	return connected
+}
+
+// Stop stops receiving the commands of the chats
+func Stop() {
+	if connected {
+		bot.StopReceivingUpdates()
+	}
+}
+
+// listen handles the commands sent by the allowed chats
+func listen() {
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+	updates, err := bot.GetUpdatesChan(u)
+	if err != nil {
+		fmt.Println("Error receiving Telegram updates:", err)
+		return
+	}
+
+	for update := range updates {
+		if update.Message == nil || !allowed(update.Message.Chat.ID) {
+			continue
+		}
+		switch update.Message.Command() {
+		case "scene":
+			reply(update.Message.Chat.ID, activateScene(strings.TrimSpace(update.Message.CommandArguments())))
+		}
+	}
+}
+
+func allowed(chatID int64) bool {
+	for _, id := range cfg.Chats {
+		if id == chatID {
+			return true
+		}
+	}
+	return false
+}
+
+func activateScene(name string) string {
+	if name == "" {
+		return "Usage: /scene <name>"
+	}
+	results, err := scene.Activate(name)
+	if results == nil {
+		return "⚠️ " + err.Error()
+	}
+	msg := "✅ Scene " + name + " activated"
+	if err != nil {
+		msg = "⚠️ Scene " + name + ": " + err.Error()
+	}
+	pending := 0
+	for _, result := range results {
+		if result.Error != "" {
+			msg += "\n" + result.Device + " " + result.Method + ": " + result.Error
+		}
+		if result.Pending {
+			pending++
+		}
+	}
+	if pending > 0 {
+		msg += fmt.Sprintf("\n%d steps will run after their delay", pending)
+	}
+	return msg
+}
+
+func reply(chatID int64, message string) {
+	msg := tgbotapi.NewMessage(chatID, message)
+	bot.Send(msg)
 }
 
 // Notify send a notification to every telegram client
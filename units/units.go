@@ -0,0 +1,157 @@
+package units
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/conejoninja/home/common"
+)
+
+// unit is converted to the base unit of its dimension as (value + offset) * num / den
+type unit struct {
+	name      string
+	dimension string
+	offset    float64
+	num, den  float64
+}
+
+var known = []unit{
+	{"degC", "temperature", 0, 1, 1},
+	{"degF", "temperature", -32, 5, 9},
+	{"K", "temperature", -273.15, 1, 1},
+	{"Pa", "pressure", 0, 1, 1},
+	{"hPa", "pressure", 0, 100, 1},
+	{"inHg", "pressure", 0, 3386.389, 1},
+	{"W", "power", 0, 1, 1},
+	{"kW", "power", 0, 1000, 1},
+	{"Wh", "energy", 0, 1, 1},
+	{"kWh", "energy", 0, 1000, 1},
+	{"%", "ratio", 0, 1, 1},
+	{"lux", "illuminance", 0, 1, 1},
+}
+
+var aliases = map[string]string{
+	"°c":      "degC",
+	"c":       "degC",
+	"degc":    "degC",
+	"celsius": "degC",
+	"ºc":      "degC",
+	"°f":      "degF",
+	"f":       "degF",
+	"degf":    "degF",
+	"ºf":      "degF",
+	"k":       "K",
+	"kelvin":  "K",
+	"pa":      "Pa",
+	"hpa":     "hPa",
+	"mbar":    "hPa",
+	"inhg":    "inHg",
+	"w":       "W",
+	"kw":      "kW",
+	"wh":      "Wh",
+	"kwh":     "kWh",
+	"%":       "%",
+	"lux":     "lux",
+	"lx":      "lux",
+}
+
+// ErrIncompatible is returned when converting between units of different dimensions
+var ErrIncompatible = errors.New("incompatible units")
+
+func lookup(name string) (unit, bool) {
+	canonical, ok := aliases[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return unit{}, false
+	}
+	for _, u := range known {
+		if u.name == canonical {
+			return u, true
+		}
+	}
+	return unit{}, false
+}
+
+// Normalize returns the canonical name of a unit, or the name itself if it's not known
+func Normalize(name string) string {
+	if u, ok := lookup(name); ok {
+		return u.name
+	}
+	return name
+}
+
+// Convert a number from one unit to another
+func Convert(value float64, from, to string) (float64, error) {
+	f, ok := lookup(from)
+	if !ok {
+		return value, fmt.Errorf("unknown unit %s", from)
+	}
+	t, ok := lookup(to)
+	if !ok {
+		return value, fmt.Errorf("unknown unit %s", to)
+	}
+	if f.dimension != t.dimension {
+		return value, ErrIncompatible
+	}
+	if f.name == t.name {
+		return value, nil
+	}
+	base := (value + f.offset) * f.num / f.den
+	return base*t.den/t.num - t.offset, nil
+}
+
+// ConvertValue converts the value, and its Min and Max, of a sensor to another unit.
+// from is used when the value doesn't carry its unit, numbers sent as strings are converted too
+func ConvertValue(value common.Value, from, to string) (common.Value, error) {
+	if value.Unit != "" {
+		from = value.Unit
+	}
+	val, err := number(value.Value)
+	if err != nil {
+		return value, err
+	}
+	if value.Value, err = Convert(val, from, to); err != nil {
+		return value, err
+	}
+	value.Min = convertLimit(value.Min, from, to)
+	value.Max = convertLimit(value.Max, from, to)
+	value.Unit = Normalize(to)
+	return value, nil
+}
+
+// ConvertMeta converts the maximum, minimum and average of a sensor to another unit, it fails if the
+// units are unknown or incompatible even without values
+func ConvertMeta(meta common.Meta, from, to string) (common.Meta, error) {
+	if _, err := Convert(0, from, to); err != nil {
+		return meta, err
+	}
+	meta.Unit = Normalize(to)
+	if meta.N == 0 {
+		return meta, nil
+	}
+	meta.Max, _ = Convert(meta.Max, from, to)
+	meta.Min, _ = Convert(meta.Min, from, to)
+	meta.Avg, _ = Convert(meta.Avg, from, to)
+	return meta, nil
+}
+
+// number returns the value of a numeric reading, which could be sent as a string
+func number(v interface{}) (float64, error) {
+	switch val := v.(type) {
+	case nil, bool:
+		return 0, errors.New("not a number")
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(val), 64)
+	}
+	return common.GetFloat(v)
+}
+
+func convertLimit(limit, from, to string) string {
+	var val float64
+	if _, err := fmt.Sscan(limit, &val); err != nil {
+		return limit
+	}
+	val, _ = Convert(val, from, to)
+	return fmt.Sprint(val)
+}
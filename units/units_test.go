@@ -0,0 +1,83 @@
+package units
+
+import (
+	"math"
+	"testing"
+
+	"github.com/conejoninja/home/common"
+)
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		value    float64
+		from, to string
+		want     float64
+	}{
+		{100, "°C", "degF", 212},
+		{32, "F", "celsius", 0},
+		{0, "degC", "K", 273.15},
+		{1013.25, "mbar", "Pa", 101325},
+		{1.5, "kWh", "Wh", 1500},
+		{20, "C", "degC", 20},
+	}
+	for _, test := range tests {
+		got, err := Convert(test.value, test.from, test.to)
+		if err != nil || !near(got, test.want) {
+			t.Errorf("Convert(%v, %s, %s) = %v, %v; want %v", test.value, test.from, test.to, got, err, test.want)
+		}
+	}
+
+	if _, err := Convert(1, "degC", "W"); err != ErrIncompatible {
+		t.Errorf("degC to W: %v", err)
+	}
+	if _, err := Convert(1, "furlong", "degC"); err == nil {
+		t.Error("unknown unit should fail")
+	}
+}
+
+func TestConvertValue(t *testing.T) {
+	value := common.Value{ID: "temperature", Value: "100", Min: "0", Max: "50"}
+	converted, err := ConvertValue(value, "degC", "degF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := converted.Value.(float64); !near(v, 212) {
+		t.Errorf("value %v", converted.Value)
+	}
+	if converted.Min != "32" || converted.Max != "122" || converted.Unit != "degF" {
+		t.Errorf("min %s max %s unit %s", converted.Min, converted.Max, converted.Unit)
+	}
+
+	// the unit of the value takes precedence
+	value = common.Value{Value: 273.15, Unit: "K"}
+	if converted, err = ConvertValue(value, "degF", "degC"); err != nil || !near(converted.Value.(float64), 0) {
+		t.Errorf("%v %v", converted.Value, err)
+	}
+
+	for _, v := range []interface{}{nil, true, "warm"} {
+		if _, err = ConvertValue(common.Value{Value: v}, "degC", "degF"); err == nil {
+			t.Errorf("%v should not be converted", v)
+		}
+	}
+}
+
+func TestConvertMeta(t *testing.T) {
+	meta, err := ConvertMeta(common.Meta{Max: 100, Min: 0, Avg: 50, N: 3}, "degC", "degF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(meta.Max, 212) || !near(meta.Min, 32) || !near(meta.Avg, 122) || meta.Unit != "degF" {
+		t.Errorf("%+v", meta)
+	}
+
+	if _, err = ConvertMeta(common.Meta{}, "degC", "W"); err == nil {
+		t.Error("incompatible units should fail without values too")
+	}
+	if _, err = ConvertMeta(common.Meta{N: 1}, "", "degC"); err == nil {
+		t.Error("a sensor without unit can't be converted")
+	}
+}